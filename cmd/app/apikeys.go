@@ -0,0 +1,178 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// apiKeyAuthenticator accepts the service API keys stored in Vault,
+// passing any other token to the configured auth backend
+type apiKeyAuthenticator struct {
+	vc      vault.AuthenticatedClient
+	backend authenticator
+	logger  logr.Logger
+}
+
+// Authenticate verifies the token against the stored API keys if
+// it is an API key, or with the auth backend otherwise
+func (a *apiKeyAuthenticator) Authenticate(ctx context.Context, token string) (*identity, error) {
+	if !strings.HasPrefix(token, operations.APIKeyPrefix) {
+		return a.backend.Authenticate(ctx, token)
+	}
+	client, err := a.vc.GetClient(a.logger)
+	if err != nil {
+		return nil, err
+	}
+	key, err := operations.VerifyAPIKey(ctx,
+		&operations.VerifyAPIKeyRequest{
+			Client:      client,
+			VaultKVPath: viper.GetString("vault-kv-path"),
+			Key:         token,
+		}, a.logger.WithValues("operation", "verifyAPIKey"))
+	if err != nil {
+		return nil, err
+	}
+	return &identity{
+		Login:  "apikey/" + key.Name,
+		APIKey: key.Name,
+		Scopes: key.Scopes,
+	}, nil
+}
+
+func createAPIKeyHandler(vc vault.AuthenticatedClient, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+
+		scopes := []string{}
+		for _, s := range strings.Split(r.URL.Query().Get("scopes"), ",") {
+			if s == "" {
+				continue
+			}
+			if !validScope(s) {
+				reportHttpError("invalid scopes "+r.URL.Query().Get("scopes"),
+					fmt.Errorf("unknown scope '%s'", s), http.StatusBadRequest, w, logger)
+				return
+			}
+			// Keys can't be granted permissions the caller doesn't have
+			if !identityFromRequest(r).can(s, "") {
+				forbidden(s, w, r, al, logger)
+				return
+			}
+			scopes = append(scopes, s)
+		}
+
+		expiresAt, err := parseDate("expires-at", r.URL.Query().Get("expires-at"))
+		if err != nil {
+			reportHttpError("invalid expires-at "+r.URL.Query().Get("expires-at"),
+				err, http.StatusBadRequest, w, logger)
+			return
+		}
+
+		key, meta, err := operations.CreateAPIKey(r.Context(),
+			&operations.CreateAPIKeyRequest{
+				Client:      client,
+				VaultKVPath: viper.GetString("vault-kv-path"),
+				Name:        r.URL.Query().Get("name"),
+				Scopes:      scopes,
+				ExpiresAt:   expiresAt,
+				CreatedBy:   actor(r),
+			}, logger.WithValues("operation", "createAPIKey"))
+		e := newAuditEntry(r, auditCreateAPIKey)
+		e.Details = map[string]string{"name": r.URL.Query().Get("name"), "scopes": strings.Join(scopes, ",")}
+		if meta != nil {
+			e.Details["id"] = meta.ID
+			e.Details["expiresAt"] = meta.ExpiresAt.Format(time.RFC3339)
+		}
+		al.Record(r.Context(), auditResult(e, err))
+		if err != nil {
+			reportHttpError("unable to create API key",
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+
+		b, err := json.MarshalIndent(map[string]any{
+			"key":    key,
+			"apiKey": meta,
+		}, "", "  ")
+		if err != nil {
+			reportHttpError("unable to parse API key",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func listAPIKeysHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		keys, err := operations.ListAPIKeys(r.Context(),
+			&operations.ListAPIKeysRequest{
+				Client:      client,
+				VaultKVPath: viper.GetString("vault-kv-path"),
+			}, logger.WithValues("operation", "listAPIKeys"))
+		if err != nil {
+			reportHttpError("unable to retrieve the API keys",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		b, err := json.MarshalIndent(keys, "", "  ")
+		if err != nil {
+			reportHttpError("unable to parse API keys",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func revokeAPIKeyHandler(vc vault.AuthenticatedClient, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		vars := mux.Vars(r)
+		key, err := operations.RevokeAPIKey(r.Context(),
+			&operations.RevokeAPIKeyRequest{
+				Client:      client,
+				VaultKVPath: viper.GetString("vault-kv-path"),
+				ID:          vars["id"],
+			}, logger.WithValues("operation", "revokeAPIKey"))
+		e := newAuditEntry(r, auditRevokeAPIKey)
+		e.Details = map[string]string{"id": vars["id"]}
+		if key != nil {
+			e.Details["name"] = key.Name
+		}
+		al.Record(r.Context(), auditResult(e, err))
+		if err != nil {
+			reportHttpError("unable to revoke API key "+vars["id"],
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success"}))
+	}
+}
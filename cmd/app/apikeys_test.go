@@ -0,0 +1,52 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+	"github.com/spf13/viper"
+)
+
+// noVaultClient is an AuthenticatedClient for the handlers that
+// must not reach Vault
+type noVaultClient struct{}
+
+func (noVaultClient) GetClient(logr.Logger) (*api.Client, error) { return nil, nil }
+func (noVaultClient) Close()                                     {}
+
+func TestCreateAPIKeyRejectsScopesTheCallerLacks(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("auth-github-org", "acme")
+	viper.Set("auth-rbac-roles", []string{"user/alice:admin"})
+
+	h := createAPIKeyHandler(noVaultClient{}, audit.NewLogger(logr.Discard()), logr.Discard())
+	tests := []struct {
+		name string
+		id   *identity
+	}{
+		{
+			name: "API key",
+			id:   &identity{Login: "apikey/keys", APIKey: "keys", Scopes: []string{permAPIKeysManage, permUsersRead}},
+		},
+		{
+			name: "user without the permission",
+			id:   &identity{Login: "bob"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/apikeys?name=ci&scopes=users:read,crl:rotate", nil)
+			r = r.WithContext(context.WithValue(r.Context(), identityContextKey{}, tt.id))
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/go-logr/logr"
+	"github.com/spf13/viper"
+)
+
+// Actions recorded in the audit log
+const (
+	auditIssueCertificate  = "certificate.issue"
+	auditRevokeCertificate = "certificate.revoke"
+	auditRevokeUser        = "user.revoke"
+	auditRevokeDevice      = "device.revoke"
+	auditUpdateCRL         = "crl.update"
+	auditRotateCRL         = "crl.rotate"
+	auditCancelExpiration  = "expiration.cancel"
+	auditCreateAPIKey      = "apikey.create"
+	auditRevokeAPIKey      = "apikey.revoke"
+	auditUseAPIKey         = "apikey.use"
+	auditDenyRequest       = "request.deny"
+)
+
+// newAuditLogger returns the audit logger for the sinks configured
+// in the audit-sinks option, as "file:<path>", "vault" or "webhook:<url>"
+func newAuditLogger(vc vault.AuthenticatedClient, logger logr.Logger) (*audit.Logger, error) {
+	sinks := []audit.Sink{}
+	for _, s := range viper.GetStringSlice("audit-sinks") {
+		kind, arg, _ := strings.Cut(s, ":")
+		switch kind {
+		case "file":
+			if arg == "" {
+				return nil, errors.New("the file audit sink requires a path, like file:/var/log/acpm/audit.log")
+			}
+			sinks = append(sinks, &audit.FileSink{Path: arg})
+		case "vault":
+			sinks = append(sinks, &audit.VaultSink{
+				Client: vc,
+				KVPath: viper.GetString("vault-kv-path"),
+				Logger: logger,
+			})
+		case "webhook":
+			if arg == "" {
+				return nil, errors.New("the webhook audit sink requires a URL, like webhook:https://example.com/audit")
+			}
+			sinks = append(sinks, &audit.WebhookSink{URL: arg, Client: &http.Client{Timeout: 10 * time.Second}})
+		default:
+			return nil, fmt.Errorf("unknown audit sink '%s'", s)
+		}
+	}
+	return audit.NewLogger(logger, sinks...), nil
+}
+
+// newAuditEntry returns an audit entry for the action
+// performed by the caller of the request
+func newAuditEntry(r *http.Request, action string) *audit.Entry {
+	return &audit.Entry{
+		Actor:    actor(r),
+		Action:   action,
+		SourceIP: r.RemoteAddr,
+		Outcome:  audit.OutcomeSuccess,
+	}
+}
+
+// newSystemAuditEntry returns an audit entry for an action
+// performed by the server itself, like the cron jobs
+func newSystemAuditEntry(action string, component string) *audit.Entry {
+	return &audit.Entry{
+		Actor:   "system/" + component,
+		Action:  action,
+		Outcome: audit.OutcomeSuccess,
+	}
+}
+
+// auditResult sets the outcome of the audited
+// action from the error it returned
+func auditResult(e *audit.Entry, err error) *audit.Entry {
+	if err != nil {
+		e.Outcome = audit.OutcomeFailure
+		e.Error = err.Error()
+	}
+	var rle *operations.RevocationLimitError
+	if errors.As(err, &rle) {
+		if e.Details == nil {
+			e.Details = map[string]string{}
+		}
+		e.Details["skipped"] = strings.Join(rle.Skipped, ",")
+	}
+	return e
+}
+
+func queryAuditHandler(al *audit.Logger, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := &audit.Query{
+			Actor:  r.URL.Query().Get("actor"),
+			Action: r.URL.Query().Get("action"),
+			User:   r.URL.Query().Get("user"),
+			Limit:  100,
+		}
+		var err error
+		if param := r.URL.Query().Get("since"); param != "" {
+			if q.Since, err = parseDate("since", param); err != nil {
+				reportHttpError("invalid since "+param, err, http.StatusBadRequest, w, logger)
+				return
+			}
+		}
+		if param := r.URL.Query().Get("until"); param != "" {
+			if q.Until, err = parseDate("until", param); err != nil {
+				reportHttpError("invalid until "+param, err, http.StatusBadRequest, w, logger)
+				return
+			}
+		}
+		if param := r.URL.Query().Get("limit"); param != "" {
+			if q.Limit, err = strconv.Atoi(param); err != nil || q.Limit < 0 {
+				reportHttpError("invalid limit "+param,
+					errors.New("limit must be a positive number, 0 means no limit"), http.StatusBadRequest, w, logger)
+				return
+			}
+		}
+
+		entries, err := al.Query(r.Context(), q)
+		if err != nil {
+			reportHttpError("unable to query the audit log",
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+		b, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			reportHttpError("unable to parse audit entries",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func verifyAuditHandler(al *audit.Logger, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := al.Verify(r.Context())
+		if errors.Is(err, audit.ErrNoReader) {
+			reportHttpError("unable to verify the audit log",
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+		if err != nil {
+			reportHttpError("audit log verification failed",
+				err, http.StatusConflict, w, logger, "entries", strconv.Itoa(n))
+			return
+		}
+		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success", "entries": strconv.Itoa(n)}))
+	}
+}
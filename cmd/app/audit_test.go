@@ -0,0 +1,46 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+)
+
+func TestAuditResult(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantOutcome string
+		wantSkipped string
+	}{
+		{
+			name:        "success",
+			wantOutcome: audit.OutcomeSuccess,
+		},
+		{
+			name:        "failure",
+			err:         errors.New("vault unavailable"),
+			wantOutcome: audit.OutcomeFailure,
+		},
+		{
+			name:        "revocation limit exceeded",
+			err:         fmt.Errorf("certificate 01 issued: %w", &operations.RevocationLimitError{Skipped: []string{"a1", "b1"}}),
+			wantOutcome: audit.OutcomeFailure,
+			wantSkipped: "a1,b1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := auditResult(newSystemAuditEntry(auditRotateCRL, "cron"), tt.err)
+			if e.Outcome != tt.wantOutcome {
+				t.Errorf("auditResult() outcome = %q, want %q", e.Outcome, tt.wantOutcome)
+			}
+			if got := e.Details["skipped"]; got != tt.wantSkipped {
+				t.Errorf("auditResult() skipped = %q, want %q", got, tt.wantSkipped)
+			}
+		})
+	}
+}
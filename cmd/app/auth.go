@@ -0,0 +1,443 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/go-logr/logr"
+	"github.com/google/go-github/github"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+// identity is the authenticated caller of the API
+type identity struct {
+	Login string
+	// Teams are the names and slugs of the GitHub teams of the caller, only
+	// resolved if the auth config requires them, or the caller's OIDC groups
+	Teams []string
+	// APIKey is the name of the API key used by the caller, if any.
+	// The permissions of API keys are their Scopes, not roles.
+	APIKey string
+	Scopes []string
+}
+
+type identityContextKey struct{}
+
+// identityFromRequest returns the identity of the caller. It
+// returns nil if the request has not been authenticated.
+func identityFromRequest(r *http.Request) *identity {
+	id, _ := r.Context().Value(identityContextKey{}).(*identity)
+	return id
+}
+
+// actor returns the name of the caller, to be used in logs
+func actor(r *http.Request) string {
+	if id := identityFromRequest(r); id != nil {
+		return id.Login
+	}
+	return "anonymous"
+}
+
+// selfService serves the request for the caller's own user, taking the
+// username from the authenticated identity instead of the request path
+func selfService(next http.HandlerFunc, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := identityFromRequest(r)
+		if id == nil {
+			reportHttpError("unauthenticated", errors.New("self-service endpoints require authentication"),
+				http.StatusUnauthorized, w, logger)
+			return
+		}
+		if id.APIKey != "" {
+			reportHttpError("forbidden", errors.New("self-service endpoints cannot be used with API keys"),
+				http.StatusForbidden, w, logger)
+			return
+		}
+		vars := map[string]string{"user": id.Login}
+		for k, v := range mux.Vars(r) {
+			if k != "user" {
+				vars[k] = v
+			}
+		}
+		next(w, mux.SetURLVars(r, vars))
+	}
+}
+
+// authenticator validates the bearer token of a
+// request and returns the identity of the caller
+type authenticator interface {
+	Authenticate(ctx context.Context, token string) (*identity, error)
+}
+
+// newAuthenticator returns the authenticator for the configured auth
+// backend, which also accepts API keys. It returns nil if authentication
+// is disabled.
+func newAuthenticator(vc vault.AuthenticatedClient, logger logr.Logger) (authenticator, error) {
+	backend, err := newBackendAuthenticator()
+	if err != nil || backend == nil {
+		return nil, err
+	}
+	return &apiKeyAuthenticator{vc: vc, backend: backend, logger: logger}, nil
+}
+
+// newBackendAuthenticator returns the authenticator for the
+// configured auth backend, or nil if there is none
+func newBackendAuthenticator() (authenticator, error) {
+	if viper.IsSet("auth-github-org") && viper.IsSet("auth-oidc-issuer") {
+		return nil, errors.New("only one of auth-github-org and auth-oidc-issuer can be set")
+	}
+	if viper.IsSet("auth-oidc-issuer") {
+		return newOIDCAuthenticator(&oidcAuthOpts{
+			Issuer:        viper.GetString("auth-oidc-issuer"),
+			JWKSURL:       viper.GetString("auth-oidc-jwks-url"),
+			Audience:      viper.GetString("auth-oidc-audience"),
+			UsernameClaim: viper.GetString("auth-oidc-username-claim"),
+			GroupsClaim:   viper.GetString("auth-oidc-groups-claim"),
+			AllowedGroups: viper.GetStringSlice("auth-oidc-groups"),
+		})
+	}
+	if viper.IsSet("auth-github-org") {
+		a := &githubAuthenticator{}
+		if ttl := viper.GetDuration("auth-cache-ttl"); ttl > 0 {
+			a.cache = newAuthCache(ttl, viper.GetDuration("auth-cache-max-stale"))
+		}
+		return a, nil
+	}
+	return nil, nil
+}
+
+// unauthenticatedPaths are the paths served without authentication
+var unauthenticatedPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// authEnabled returns true if any auth backend is configured
+func authEnabled() bool {
+	return viper.IsSet("auth-github-org") || viper.IsSet("auth-oidc-issuer") || viper.IsSet("auth-mtls-pki-role")
+}
+
+func authMiddleware(next http.Handler, auth authenticator, mtls *mtlsAuthenticator, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var token string
+
+		// Auth enabled, except for the health probes
+		if !unauthenticatedPaths[r.URL.Path] && (auth != nil || mtls != nil) {
+			var id *identity
+			var err error
+
+			if mtls != nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+				// Callers that present a client certificate are authenticated by it
+				id, err = mtls.Authenticate(r.Context(), r.TLS.PeerCertificates)
+			} else if auth != nil {
+				if r.Header.Get("Authorization") != "" {
+
+					// Header should be: "Authorization: Bearer <token>"
+					h := strings.Split(r.Header.Get("Authorization"), " ")
+					if len(h) == 2 && h[0] == "Bearer" {
+						token = h[1]
+					} else {
+						reportHttpError("unauthenticated", errors.New("invalid Authorization header"), http.StatusUnauthorized, w, logger)
+						return
+					}
+				}
+				id, err = auth.Authenticate(r.Context(), token)
+			} else {
+				err = errors.New("client certificate required")
+			}
+
+			if err != nil {
+				reportHttpError("unauthenticated", err, http.StatusUnauthorized, w, logger)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), identityContextKey{}, id))
+			if id.APIKey != "" {
+				e := newAuditEntry(r, auditUseAPIKey)
+				e.Details = map[string]string{"method": r.Method, "path": r.URL.Path}
+				al.Record(r.Context(), e)
+			}
+		}
+		// Hanle request to the next handler in the chain
+		next.ServeHTTP(w, r)
+	}
+}
+
+// githubAuthenticator authenticates GitHub personal access tokens
+type githubAuthenticator struct {
+	// cache is optional, if nil GitHub is queried on every request
+	cache *authCache
+}
+
+// Authenticate validates the token with the GitHub API. If caching is
+// enabled, the identity resolved for a token is reused until it expires,
+// and GitHub is not queried at all while its rate limit is exceeded.
+func (a *githubAuthenticator) Authenticate(ctx context.Context, token string) (*identity, error) {
+	if a.cache == nil {
+		return a.authenticate(ctx, token)
+	}
+	if id, ok := a.cache.get(token); ok {
+		return id, nil
+	}
+	if until := a.cache.rateLimited(); !until.IsZero() {
+		return nil, fmt.Errorf("GitHub API rate limit exceeded, retry after %s", until.Format(time.RFC3339))
+	}
+
+	id, err := a.authenticate(ctx, token)
+	if err != nil {
+		if until, ok := githubRateLimitReset(err); ok {
+			a.cache.setRateLimited(until)
+		}
+		return nil, err
+	}
+	a.cache.set(token, id)
+	return id, nil
+}
+
+func (a *githubAuthenticator) authenticate(ctx context.Context, token string) (*identity, error) {
+	gh := githubAuthOpts{
+		Token:        token,
+		Organization: viper.GetString("auth-github-org"),
+		BaseURL:      viper.GetString("auth-github-base-url"),
+	}
+	if viper.IsSet("auth-github-users") {
+		gh.AllowedUsers = viper.GetStringSlice("auth-github-users")
+	} else {
+		gh.AllowedUsers = []string{}
+	}
+	if viper.IsSet("auth-github-teams") {
+		gh.AllowedTeams = viper.GetStringSlice("auth-github-teams")
+	} else {
+		gh.AllowedTeams = []string{}
+	}
+
+	gh.ResolveTeams = subjectsIncludeTeams(viper.GetStringSlice("auth-pki-roles")) ||
+		subjectsIncludeTeams(viper.GetStringSlice("auth-rbac-roles"))
+
+	return githubAuth(ctx, &gh)
+}
+
+// githubAuthOpts configured this auth backend
+type githubAuthOpts struct {
+	Token        string
+	Organization string
+	AllowedUsers []string
+	AllowedTeams []string
+	// BaseURL is the API URL of a GitHub Enterprise
+	// server. If empty, github.com is used.
+	BaseURL string
+	// ResolveTeams retrieves the teams of the user even
+	// if AllowedTeams is not set
+	ResolveTeams bool
+}
+
+// newGithubClient returns a GitHub client that uses the token of the
+// options, talking to a GitHub Enterprise server if a base URL is set
+func newGithubClient(ctx context.Context, gh *githubAuthOpts) (*github.Client, error) {
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: gh.Token},
+	)
+	tc := oauth2.NewClient(ctx, ts)
+
+	if gh.BaseURL != "" {
+		return github.NewEnterpriseClient(gh.BaseURL, gh.BaseURL, tc)
+	}
+	return github.NewClient(tc), nil
+}
+
+// githubRateLimitReset returns the time when GitHub will accept requests
+// again if the error is caused by its primary or secondary rate limits
+func githubRateLimitReset(err error) (time.Time, bool) {
+	var rle *github.RateLimitError
+	if errors.As(err, &rle) {
+		return rle.Rate.Reset.Time, true
+	}
+	var arle *github.AbuseRateLimitError
+	if errors.As(err, &arle) {
+		if arle.RetryAfter != nil {
+			return time.Now().Add(*arle.RetryAfter), true
+		}
+		return time.Now().Add(time.Minute), true
+	}
+	return time.Time{}, false
+}
+
+// githubAuth validates if the provided Github personal token
+// has access to the server by talking to the Github API. It
+// returns the identity of the owner of the token.
+func githubAuth(ctx context.Context, gh *githubAuthOpts) (*identity, error) {
+
+	allowedUser := false
+	allowedTeam := false
+
+	client, err := newGithubClient(ctx, gh)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the user
+	user, _, err := client.Users.Get(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify that the user is part of the organization
+	var org *github.Organization
+	orgOpt := &github.ListOptions{
+		PerPage: 100,
+	}
+
+	var allOrgs []*github.Organization
+	for {
+		orgs, resp, err := client.Organizations.List(ctx, "", orgOpt)
+		if err != nil {
+			return nil, err
+		}
+		allOrgs = append(allOrgs, orgs...)
+		if resp.NextPage == 0 {
+			break
+		}
+		orgOpt.Page = resp.NextPage
+	}
+
+	for _, o := range allOrgs {
+		if strings.EqualFold(*o.Login, gh.Organization) {
+			org = o
+			break
+		}
+	}
+	if org == nil {
+		return nil, errors.New("user is not part of required org")
+	}
+
+	id := &identity{Login: *user.Login}
+
+	if len(gh.AllowedTeams) != 0 || gh.ResolveTeams {
+		// Get the teams that this user is part of to determine the policies
+		var teamNames []string
+		teamOpt := &github.ListOptions{
+			PerPage: 100,
+		}
+		var allTeams []*github.Team
+		for {
+			teams, resp, err := client.Teams.ListUserTeams(ctx, teamOpt)
+			if err != nil {
+				return nil, err
+			}
+			allTeams = append(allTeams, teams...)
+			if resp.NextPage == 0 {
+				break
+			}
+			teamOpt.Page = resp.NextPage
+		}
+
+		for _, t := range allTeams {
+			// We only care about teams that are part of the organization we use
+			if *t.Organization.ID != *org.ID {
+				continue
+			}
+
+			// Append the names so we can get the policies
+			teamNames = append(teamNames, *t.Name)
+			if *t.Name != *t.Slug {
+				teamNames = append(teamNames, *t.Slug)
+			}
+		}
+
+		id.Teams = teamNames
+
+		for _, t := range teamNames {
+			for _, at := range gh.AllowedTeams {
+				if strings.EqualFold(t, at) {
+					allowedTeam = true
+					break
+				}
+			}
+			if allowedTeam {
+				break
+			}
+		}
+	}
+
+	if len(gh.AllowedUsers) != 0 {
+		for _, u := range gh.AllowedUsers {
+			if strings.EqualFold(*user.Login, u) {
+				allowedUser = true
+				break
+			}
+		}
+	}
+
+	// If neither AllowedTeams not AllowedUsers is set, any user
+	// that belongs to the organization is allowed
+	if len(gh.AllowedTeams) == 0 && len(gh.AllowedUsers) == 0 {
+		return id, nil
+	} else if len(gh.AllowedUsers) > 0 && allowedUser {
+		return id, nil
+	} else if len(gh.AllowedTeams) > 0 && allowedTeam {
+		return id, nil
+	}
+
+	return nil, errors.New("the user does not match any of the allowed users/teams")
+}
+
+// matchesSubject returns true if the identity matches a subject of an
+// authorization mapping. Subjects can be "user/<login>", "team/<name or slug>",
+// "group/<name>" (an alias of team, for OIDC groups), "apikey/<name>" or "*"
+// to match any caller.
+func (id *identity) matchesSubject(subject string) bool {
+	if subject == "*" {
+		return true
+	}
+	if id == nil {
+		return false
+	}
+	kind, name, _ := strings.Cut(subject, "/")
+	switch kind {
+	case "user":
+		return strings.EqualFold(id.Login, name)
+	case "apikey":
+		return id.APIKey != "" && strings.EqualFold(id.APIKey, name)
+	case "team", "group":
+		for _, t := range id.Teams {
+			if strings.EqualFold(t, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// subjectsIncludeTeams returns true if any entry of an authorization
+// mapping (in "<subject>:<value>" format) has a team as subject
+func subjectsIncludeTeams(mapping []string) bool {
+	for _, entry := range mapping {
+		if strings.HasPrefix(entry, "team/") || strings.HasPrefix(entry, "group/") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedPKIRole returns true if the caller is allowed to request certificates
+// from the given Vault PKI role. If no role mapping is configured, any role
+// is allowed.
+func allowedPKIRole(id *identity, role string) bool {
+	if !viper.IsSet("auth-pki-roles") {
+		return true
+	}
+	for _, entry := range viper.GetStringSlice("auth-pki-roles") {
+		subject, r, found := strings.Cut(entry, ":")
+		if found && r == role && id.matchesSubject(subject) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/go-logr/logr"
+)
+
+type denyAuthenticator struct{}
+
+func (denyAuthenticator) Authenticate(ctx context.Context, token string) (*identity, error) {
+	return nil, errors.New("invalid token")
+}
+
+func TestAuthMiddlewareOnlyExemptsProbes(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := authMiddleware(next, denyAuthenticator{}, nil, audit.NewLogger(logr.Discard()), logr.Discard())
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/healthz", http.StatusOK},
+		{http.MethodGet, "/readyz", http.StatusOK},
+		{http.MethodPost, "/issue/alice/devices/laptopz", http.StatusUnauthorized},
+		{http.MethodPost, "/revoke/alice/devices/xz", http.StatusUnauthorized},
+		{http.MethodGet, "/healthz/x", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package app
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/metrics"
+)
+
+var (
+	authCacheHits   = metrics.AuthCacheRequests.WithLabelValues("hit")
+	authCacheMisses = metrics.AuthCacheRequests.WithLabelValues("miss")
+	authCacheStale  = metrics.AuthCacheRequests.WithLabelValues("stale_hit")
+)
+
+type authCacheEntry struct {
+	id      *identity
+	created time.Time
+}
+
+// authCache stores the identities resolved for each token, so the identity
+// provider is not queried on every request. Tokens are never stored, entries
+// are keyed by the sha256 hash of the token.
+type authCache struct {
+	ttl time.Duration
+	// maxStale is how long an expired entry can still be served
+	// while the identity provider is rate limiting us
+	maxStale time.Duration
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]authCacheEntry
+	// rateLimitedUntil is set when the identity provider
+	// asks us to stop sending requests for a while
+	rateLimitedUntil time.Time
+}
+
+func newAuthCache(ttl time.Duration, maxStale time.Duration) *authCache {
+	return &authCache{
+		ttl:      ttl,
+		maxStale: maxStale,
+		entries:  map[[sha256.Size]byte]authCacheEntry{},
+	}
+}
+
+// get returns the identity cached for the token. Expired entries are only
+// returned while the identity provider is rate limiting us, for maxStale.
+func (c *authCache) get(token string) (*identity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[sha256.Sum256([]byte(token))]
+	if ok {
+		age := time.Since(e.created)
+		if age < c.ttl {
+			authCacheHits.Inc()
+			return e.id, true
+		}
+		if time.Now().Before(c.rateLimitedUntil) && age < c.ttl+c.maxStale {
+			authCacheStale.Inc()
+			return e.id, true
+		}
+	}
+	authCacheMisses.Inc()
+	return nil, false
+}
+
+// set caches the identity resolved for the token, evicting
+// the entries that can no longer be served
+func (c *authCache) set(token string, id *identity) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.Sub(e.created) >= c.ttl+c.maxStale {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[sha256.Sum256([]byte(token))] = authCacheEntry{id: id, created: now}
+}
+
+// rateLimited returns the time until which no requests should be sent
+// to the identity provider, or the zero time if we are not rate limited
+func (c *authCache) rateLimited() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Now().Before(c.rateLimitedUntil) {
+		return c.rateLimitedUntil
+	}
+	return time.Time{}
+}
+
+// setRateLimited stops the requests to the identity provider until the given time
+func (c *authCache) setRateLimited(until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if until.After(c.rateLimitedUntil) {
+		c.rateLimitedUntil = until
+	}
+}
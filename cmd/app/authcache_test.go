@@ -0,0 +1,125 @@
+package app
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+// age moves the creation time of the entry cached for the token back by d
+func (c *authCache) age(token string, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := sha256.Sum256([]byte(token))
+	e := c.entries[k]
+	e.created = e.created.Add(-d)
+	c.entries[k] = e
+}
+
+func TestAuthCacheGet(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxStale    time.Duration
+		age         time.Duration
+		rateLimited bool
+		wantHit     bool
+	}{
+		{
+			name:    "within the ttl",
+			age:     time.Minute,
+			wantHit: true,
+		},
+		{
+			name: "expired",
+			age:  10 * time.Minute,
+		},
+		{
+			name:        "expired while rate limited without max stale",
+			age:         10 * time.Minute,
+			rateLimited: true,
+		},
+		{
+			name:     "expired within max stale but not rate limited",
+			maxStale: 10 * time.Minute,
+			age:      10 * time.Minute,
+		},
+		{
+			name:        "expired within max stale while rate limited",
+			maxStale:    10 * time.Minute,
+			age:         10 * time.Minute,
+			rateLimited: true,
+			wantHit:     true,
+		},
+		{
+			name:        "expired beyond max stale while rate limited",
+			maxStale:    10 * time.Minute,
+			age:         20 * time.Minute,
+			rateLimited: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newAuthCache(5*time.Minute, tt.maxStale)
+			c.set("token", &identity{Login: "alice"})
+			c.age("token", tt.age)
+			if tt.rateLimited {
+				c.setRateLimited(time.Now().Add(time.Hour))
+			}
+
+			id, ok := c.get("token")
+			if ok != tt.wantHit {
+				t.Fatalf("get() hit = %t, want %t", ok, tt.wantHit)
+			}
+			if ok && id.Login != "alice" {
+				t.Errorf("get() login = %q, want alice", id.Login)
+			}
+		})
+	}
+}
+
+func TestAuthCacheUnknownToken(t *testing.T) {
+	c := newAuthCache(5*time.Minute, 0)
+	c.set("token", &identity{Login: "alice"})
+	if id, ok := c.get("other"); ok {
+		t.Errorf("get() = %+v for a token never cached", id)
+	}
+}
+
+func TestAuthCacheSetEvictsExpiredEntries(t *testing.T) {
+	c := newAuthCache(5*time.Minute, 10*time.Minute)
+	c.set("expired", &identity{Login: "alice"})
+	c.age("expired", 15*time.Minute)
+	c.set("stale", &identity{Login: "bob"})
+	c.age("stale", 10*time.Minute)
+	c.set("token", &identity{Login: "carol"})
+
+	if _, ok := c.entries[sha256.Sum256([]byte("expired"))]; ok {
+		t.Errorf("entry beyond max stale was not evicted")
+	}
+	if _, ok := c.entries[sha256.Sum256([]byte("stale"))]; !ok {
+		t.Errorf("entry within max stale was evicted")
+	}
+	if n := len(c.entries); n != 2 {
+		t.Errorf("cache has %d entries, want 2", n)
+	}
+}
+
+func TestAuthCacheRateLimited(t *testing.T) {
+	c := newAuthCache(5*time.Minute, 0)
+	if until := c.rateLimited(); !until.IsZero() {
+		t.Errorf("rateLimited() = %v, want zero time", until)
+	}
+
+	until := time.Now().Add(time.Hour)
+	c.setRateLimited(until)
+	// An earlier reset doesn't shorten the current limit
+	c.setRateLimited(time.Now().Add(time.Minute))
+	if got := c.rateLimited(); !got.Equal(until) {
+		t.Errorf("rateLimited() = %v, want %v", got, until)
+	}
+
+	c.rateLimitedUntil = time.Now().Add(-time.Second)
+	if got := c.rateLimited(); !got.IsZero() {
+		t.Errorf("rateLimited() = %v after the limit reset, want zero time", got)
+	}
+}
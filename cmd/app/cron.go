@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"sync"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/ha"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/jobs"
+	"github.com/go-logr/logr"
+)
+
+// cronActor is the actor of the cron jobs in the job history
+const cronActor = "system/cron"
+
+// cronJob is the work of a cron job. logger records
+// the lines logged in the job history.
+type cronJob func(ctx context.Context, logger logr.Logger) error
+
+// jobGroup tracks the running cron jobs, so the
+// server can wait for them to finish before exiting
+type jobGroup struct {
+	// elector tells if this replica has to run the
+	// jobs. Nil if HA mode is disabled.
+	elector *ha.Elector
+	// history records the runs of the jobs
+	history *jobs.Manager
+	logger  logr.Logger
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	closed  bool
+}
+
+// wrap returns the job tracked by the group. Each run is traced and
+// recorded in the job history. Runs that are triggered once the group
+// is closed, while other replica is the leader, or while the previous
+// run of the job is still in progress, are skipped.
+func (g *jobGroup) wrap(ctx context.Context, name string, job cronJob) func() {
+	var running sync.Mutex
+	return func() {
+		if g.elector != nil && !g.elector.IsLeader() {
+			return
+		}
+		g.mu.Lock()
+		if g.closed {
+			g.mu.Unlock()
+			return
+		}
+		g.wg.Add(1)
+		g.mu.Unlock()
+		defer g.wg.Done()
+
+		if !running.TryLock() {
+			g.logger.V(1).Info("Previous run of the cron job still in progress, skipping", "job", name)
+			return
+		}
+		defer running.Unlock()
+
+		ctx, span := startCronSpan(ctx, name)
+		defer span.End()
+		_, err := g.history.Run(ctx, "cron."+name, cronActor, func(ctx context.Context, logger logr.Logger) (any, error) {
+			return nil, job(ctx, logger)
+		})
+		if err == nil {
+			cronSucceeded(name)
+		}
+	}
+}
+
+// wait closes the group and waits for the running
+// jobs to finish, or until ctx is done
+func (g *jobGroup) wait(ctx context.Context) error {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/ha"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/go-logr/logr"
+	"github.com/spf13/viper"
+)
+
+// Names of the locks in the kv store
+const (
+	leaderLockName    = "leader"
+	mutationsLockName = "mutations"
+)
+
+// newHA returns the leader elector and the lock that serializes the
+// changes across replicas, or nil for both if HA mode is disabled
+func newHA(vc vault.AuthenticatedClient, logger logr.Logger) (*ha.Elector, *ha.Lock) {
+	if !viper.GetBool("ha-enabled") {
+		return nil, nil
+	}
+	ttl := viper.GetDuration("ha-lock-ttl")
+	replica := viper.GetString("ha-replica-id")
+	kvPath := viper.GetString("vault-kv-path")
+	logger = logger.WithValues("replica", replica)
+	leader := ha.NewLock(vc, kvPath, leaderLockName, replica, ttl, logger)
+	mutations := ha.NewLock(vc, kvPath, mutationsLockName, replica, ttl, logger)
+	return ha.NewElector(leader, logger), mutations
+}
+
+// lockMutations takes the mutations lock, if HA mode is enabled.
+// The returned function releases it.
+func lockMutations(ctx context.Context, lock *ha.Lock) (func(), error) {
+	if lock == nil {
+		return func() {}, nil
+	}
+	return lock.Lock(ctx)
+}
+
+// serializeMutations holds the mutations lock while serving the
+// requests that change state, so they don't race with the changes
+// made by other replicas
+func serializeMutations(next http.Handler, lock *ha.Lock, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		unlock, err := lockMutations(r.Context(), lock)
+		if err != nil {
+			reportHttpError("unable to acquire the mutations lock",
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+		defer unlock()
+		next.ServeHTTP(w, r)
+	}
+}
+
+func haStatusHandler(elector *ha.Elector, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Without HA mode, the only replica is always the leader
+		rsp := struct {
+			Enabled bool `json:"enabled"`
+			*ha.Status
+		}{
+			Enabled: elector != nil,
+			Status:  &ha.Status{Replica: viper.GetString("ha-replica-id"), Leader: true},
+		}
+		if elector != nil {
+			rsp.Status = elector.Status()
+		}
+		b, err := json.MarshalIndent(rsp, "", "  ")
+		if err != nil {
+			reportHttpError("unable to encode the HA status",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/metrics"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/tracing"
+	"github.com/felixge/httpsnoop"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Names of the cron jobs in the metrics and traces
+const (
+	cronRotateCRL          = "rotate-crl"
+	cronPendingRevocations = "pending-revocations"
+	cronAccessExpirations  = "access-expirations"
+	cronUserActivity       = "user-activity"
+	cronGithubReconcile    = "github-reconcile"
+	cronCRLWatchdog        = "crl-watchdog"
+	cronPruneJobs          = "prune-jobs"
+)
+
+var tracer = otel.Tracer(tracing.ServiceName)
+
+// instrumentHandler records the count and latency of the requests by
+// route and starts the server span of the request, continuing the trace
+// of the caller if any. It wraps the auth middleware, so rejected
+// requests are counted too.
+func instrumentHandler(next http.Handler, router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Use the route template, so the metrics don't
+		// get a new label value for each user
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if tpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+			))
+		defer span.End()
+
+		m := httpsnoop.CaptureMetrics(next, w, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", m.Code))
+		if m.Code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(m.Code))
+		}
+		metrics.HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(m.Code)).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(route, r.Method).Observe(m.Duration.Seconds())
+	}
+}
+
+// startCronSpan starts the root span of a run of the cron job. ctx
+// is the context of the server, which is cancelled when it stops.
+func startCronSpan(ctx context.Context, job string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "cron "+job,
+		trace.WithNewRoot(),
+		trace.WithAttributes(attribute.String("cron.job", job)))
+}
+
+// cronSucceeded records a successful run of the cron job
+func cronSucceeded(job string) {
+	metrics.CronLastSuccess.WithLabelValues(job).SetToCurrentTime()
+}
@@ -0,0 +1,212 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/ha"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/jobs"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+)
+
+// defaultJobsLimit is how many jobs are listed if no limit is requested
+const defaultJobsLimit = 50
+
+// secretResultFields are the fields of the responses that are not kept in
+// the job history, like the client configuration, which has the private
+// key. Clients retrieve the configuration from /users/{user}/config.
+var secretResultFields = []string{"config"}
+
+// requestLogger returns the logger of the job serving the
+// request, if it runs in the background, or logger otherwise
+func requestLogger(r *http.Request, logger logr.Logger) logr.Logger {
+	if l, err := logr.FromContext(r.Context()); err == nil {
+		return l
+	}
+	return logger
+}
+
+// jobResponseWriter keeps the response of a handler run in the background
+type jobResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *jobResponseWriter) Header() http.Header { return w.header }
+
+func (w *jobResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+func (w *jobResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// result returns the response as the result of the job: the JSON the
+// handler wrote, without its secretResultFields, and the error it
+// reported if it didn't succeed
+func (w *jobResponseWriter) result() (any, error) {
+	var result any = json.RawMessage(w.body.Bytes())
+	if !json.Valid(w.body.Bytes()) {
+		result = w.body.String()
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(w.body.Bytes(), &fields); err == nil {
+		for _, f := range secretResultFields {
+			delete(fields, f)
+		}
+		result = fields
+	}
+	if w.status < http.StatusBadRequest {
+		return result, nil
+	}
+	rsp := map[string]string{}
+	if err := json.Unmarshal(w.body.Bytes(), &rsp); err == nil && rsp["error"] != "" {
+		return result, errors.New(rsp["error"])
+	}
+	return result, fmt.Errorf("request failed with status code %d", w.status)
+}
+
+// asyncHandler runs the request as a background job when the "async"
+// parameter is true, and responds right away with the job, which can
+// be followed in /jobs/{id}. The job stops if the server does, unless
+// it is already changing the PKI. Other requests are served as usual.
+func asyncHandler(ctx context.Context, kind string, next http.HandlerFunc, jm *jobs.Manager, mutations *ha.Lock, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("async") != "true" {
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			reportHttpError("unable to read the request body",
+				err, http.StatusBadRequest, w, logger)
+			return
+		}
+
+		// The job keeps the values of the request, like the caller's
+		// identity, but not its deadline, as it outlives the request
+		jobCtx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+		stop := context.AfterFunc(ctx, cancel)
+		job, err := jm.Submit(jobCtx, kind, actor(r), func(ctx context.Context, logger logr.Logger) (any, error) {
+			defer cancel()
+			defer stop()
+
+			// The request that submitted the job held the mutations
+			// lock, but it is released once the job is submitted
+			unlock, err := lockMutations(ctx, mutations)
+			if err != nil {
+				logger.Error(err, "Unable to acquire the mutations lock")
+				return nil, err
+			}
+			defer unlock()
+
+			jr := r.Clone(logr.NewContext(ctx, logger))
+			jr.Body = io.NopCloser(bytes.NewReader(body))
+			jw := &jobResponseWriter{header: http.Header{}}
+			next(jw, jr)
+			return jw.result()
+		})
+		if err != nil {
+			stop()
+			cancel()
+			reportHttpError("unable to submit job",
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+
+		b, err := json.MarshalIndent(job, "", "  ")
+		if err != nil {
+			reportHttpError("unable to encode the job",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+// listJobsHandler lists the job history. Callers that can only
+// read their own jobs only get the jobs they started.
+func listJobsHandler(jm *jobs.Manager, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := identityFromRequest(r)
+		if !id.can(permJobsRead, actor(r)) {
+			forbidden(permJobsRead, w, r, al, logger)
+			return
+		}
+
+		q := &jobs.Query{
+			Kind:  r.URL.Query().Get("kind"),
+			Actor: r.URL.Query().Get("actor"),
+			Limit: defaultJobsLimit,
+		}
+		if param := r.URL.Query().Get("limit"); param != "" {
+			limit, err := strconv.Atoi(param)
+			if err != nil || limit <= 0 {
+				reportHttpError("invalid limit "+param,
+					fmt.Errorf("limit must be a positive integer"), http.StatusBadRequest, w, logger)
+				return
+			}
+			q.Limit = limit
+		}
+		if !id.can(permJobsRead, "") {
+			q.Actor = actor(r)
+		}
+
+		list, err := jm.List(r.Context(), q)
+		if err != nil {
+			reportHttpError("unable to list jobs",
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+		b, err := json.MarshalIndent(list, "", "  ")
+		if err != nil {
+			reportHttpError("unable to encode the jobs",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+// getJobHandler returns a job with its logs and result. Callers
+// that can only read their own jobs can't see the jobs of others.
+func getJobHandler(jm *jobs.Manager, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		job, err := jm.Get(r.Context(), id)
+		if err != nil {
+			reportHttpError("unable to retrieve job "+id,
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+		if !identityFromRequest(r).can(permJobsRead, job.Actor) {
+			forbidden(permJobsRead, w, r, al, logger)
+			return
+		}
+		b, err := json.MarshalIndent(job, "", "  ")
+		if err != nil {
+			reportHttpError("unable to encode the job",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
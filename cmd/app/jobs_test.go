@@ -0,0 +1,34 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestJobResultStripsSecretFields(t *testing.T) {
+	w := &jobResponseWriter{header: http.Header{}}
+	w.Write([]byte(jsonOutput(map[string]string{"result": "success", "config": "<key>...</key>"})))
+
+	result, err := w.result()
+	if err != nil {
+		t.Fatalf("result() error = %v", err)
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `{"result":"success"}`; got != want {
+		t.Errorf("result() = %s, want %s", got, want)
+	}
+}
+
+func TestJobResultReportsErrors(t *testing.T) {
+	w := &jobResponseWriter{header: http.Header{}}
+	w.WriteHeader(http.StatusConflict)
+	w.Write([]byte(`{"error": "device quota exceeded"}`))
+
+	if _, err := w.result(); err == nil || err.Error() != "device quota exceeded" {
+		t.Errorf("result() error = %v, want the reported error", err)
+	}
+}
@@ -0,0 +1,231 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// jwksRefreshInterval is the minimum time between two fetches of
+// the issuer's JWKS, so tokens signed with unknown keys can't be
+// used to flood the issuer with requests
+const jwksRefreshInterval = time.Minute
+
+// oidcSignatureAlgorithms are the algorithms accepted in the JWT bearer tokens
+var oidcSignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// oidcAuthOpts configures the OIDC auth backend
+type oidcAuthOpts struct {
+	Issuer string
+	// JWKSURL is the URL of the issuer's signing keys. If not set, it
+	// is discovered from the issuer's openid-configuration document.
+	JWKSURL       string
+	Audience      string
+	UsernameClaim string
+	GroupsClaim   string
+	// AllowedGroups restricts access to the members of the
+	// given groups. If empty, any valid token is allowed.
+	AllowedGroups []string
+}
+
+// oidcAuthenticator validates JWT bearer tokens issued by an OIDC provider
+type oidcAuthenticator struct {
+	opts   *oidcAuthOpts
+	client *http.Client
+
+	mu          sync.Mutex
+	jwks        *jose.JSONWebKeySet
+	lastRefresh time.Time
+}
+
+func newOIDCAuthenticator(opts *oidcAuthOpts) (*oidcAuthenticator, error) {
+	if opts.Audience == "" {
+		return nil, errors.New("auth-oidc-audience is required when auth-oidc-issuer is set")
+	}
+	if opts.UsernameClaim == "" {
+		return nil, errors.New("auth-oidc-username-claim cannot be empty")
+	}
+	return &oidcAuthenticator{
+		opts:   opts,
+		client: &http.Client{Timeout: config.AuthApiTimeout},
+	}, nil
+}
+
+// Authenticate validates the signature and the standard claims of the
+// token, and maps the configured claims to the identity of the caller
+func (a *oidcAuthenticator) Authenticate(ctx context.Context, token string) (*identity, error) {
+	if token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+	tok, err := jwt.ParseSigned(token, oidcSignatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if len(tok.Headers) != 1 {
+		return nil, errors.New("invalid token: expected a single signature")
+	}
+
+	key, err := a.key(ctx, tok.Headers[0].KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	std := jwt.Claims{}
+	claims := map[string]any{}
+	if err := tok.Claims(key, &std, &claims); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	err = std.ValidateWithLeeway(jwt.Expected{
+		Issuer:      a.opts.Issuer,
+		AnyAudience: jwt.Audience{a.opts.Audience},
+		Time:        time.Now(),
+	}, jwt.DefaultLeeway)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	// Validate doesn't require an expiration, and a token
+	// without one would be valid forever
+	if std.Expiry == nil {
+		return nil, errors.New("invalid token: claim 'exp' missing")
+	}
+
+	username, ok := claims[a.opts.UsernameClaim].(string)
+	if !ok || username == "" {
+		return nil, fmt.Errorf("invalid token: claim '%s' missing or not a string", a.opts.UsernameClaim)
+	}
+	id := &identity{Login: username, Teams: stringsClaim(claims[a.opts.GroupsClaim])}
+
+	if len(a.opts.AllowedGroups) == 0 {
+		return id, nil
+	}
+	for _, g := range id.Teams {
+		for _, ag := range a.opts.AllowedGroups {
+			if strings.EqualFold(g, ag) {
+				return id, nil
+			}
+		}
+	}
+	return nil, errors.New("the user does not belong to any of the allowed groups")
+}
+
+// key returns the issuer's key with the given id. The JWKS is refreshed
+// when the key is unknown, in case the issuer has rotated its keys.
+func (a *oidcAuthenticator) key(ctx context.Context, kid string) (*jose.JSONWebKey, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.jwks != nil {
+		if k := findKey(a.jwks, kid); k != nil {
+			return k, nil
+		}
+		if time.Since(a.lastRefresh) < jwksRefreshInterval {
+			return nil, fmt.Errorf("invalid token: unknown signing key '%s'", kid)
+		}
+	}
+
+	jwks, err := a.fetchJWKS(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve the issuer's signing keys: %w", err)
+	}
+	a.jwks = jwks
+	a.lastRefresh = time.Now()
+
+	if k := findKey(a.jwks, kid); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("invalid token: unknown signing key '%s'", kid)
+}
+
+// fetchJWKS downloads the issuer's signing keys, discovering
+// the JWKS URL first if it has not been configured
+func (a *oidcAuthenticator) fetchJWKS(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	jwksURL := a.opts.JWKSURL
+	if jwksURL == "" {
+		discovery := struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		err := a.getJSON(ctx, strings.TrimSuffix(a.opts.Issuer, "/")+"/.well-known/openid-configuration", &discovery)
+		if err != nil {
+			return nil, err
+		}
+		if discovery.Issuer != a.opts.Issuer {
+			return nil, fmt.Errorf("issuer '%s' in openid-configuration does not match '%s'", discovery.Issuer, a.opts.Issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("jwks_uri missing in openid-configuration")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	jwks := &jose.JSONWebKeySet{}
+	if err := a.getJSON(ctx, jwksURL, jwks); err != nil {
+		return nil, err
+	}
+	return jwks, nil
+}
+
+func (a *oidcAuthenticator) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status code %d", url, rsp.StatusCode)
+	}
+	return json.NewDecoder(rsp.Body).Decode(v)
+}
+
+// findKey returns the signing key with the given id. Tokens without
+// a key id are accepted if the issuer has a single signing key.
+func findKey(jwks *jose.JSONWebKeySet, kid string) *jose.JSONWebKey {
+	if kid == "" {
+		if len(jwks.Keys) == 1 {
+			return &jwks.Keys[0]
+		}
+		return nil
+	}
+	for _, k := range jwks.Key(kid) {
+		if k.Use == "" || k.Use == "sig" {
+			return &k
+		}
+	}
+	return nil
+}
+
+// stringsClaim returns the value of a claim that can be either
+// a string or a list of strings, like the groups claim
+func stringsClaim(v any) []string {
+	switch c := v.(type) {
+	case string:
+		return []string{c}
+	case []any:
+		values := []string{}
+		for _, e := range c {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
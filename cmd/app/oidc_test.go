@@ -0,0 +1,348 @@
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const testAudience = "acpm"
+
+// testIssuer is an OIDC provider that serves its discovery
+// document and its signing keys, which can be rotated
+type testIssuer struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu         sync.Mutex
+	keys       map[string]*ecdsa.PrivateKey
+	jwksGets   int
+	issuerName string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	ti := &testIssuer{t: t, keys: map[string]*ecdsa.PrivateKey{}}
+	ti.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ti.mu.Lock()
+		defer ti.mu.Unlock()
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			issuer := ti.issuerName
+			if issuer == "" {
+				issuer = ti.srv.URL
+			}
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": ti.srv.URL + "/keys"})
+		case "/keys":
+			ti.jwksGets++
+			jwks := jose.JSONWebKeySet{}
+			for kid, key := range ti.keys {
+				jwks.Keys = append(jwks.Keys, jose.JSONWebKey{Key: &key.PublicKey, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"})
+			}
+			json.NewEncoder(w).Encode(jwks)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ti.srv.Close)
+	return ti
+}
+
+// addKey generates a new signing key published with the given id
+func (ti *testIssuer) addKey(kid string) *ecdsa.PrivateKey {
+	ti.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ti.t.Fatal(err)
+	}
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.keys[kid] = key
+	return key
+}
+
+func (ti *testIssuer) removeKey(kid string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	delete(ti.keys, kid)
+}
+
+func (ti *testIssuer) fetches() int {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	return ti.jwksGets
+}
+
+// token returns a token signed with key, with the
+// given claims on top of valid standard ones
+func (ti *testIssuer) token(key any, alg jose.SignatureAlgorithm, kid string, claims map[string]any) string {
+	ti.t.Helper()
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if kid != "" {
+		opts = opts.WithHeader(jose.HeaderKey("kid"), kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		ti.t.Fatal(err)
+	}
+	now := time.Now()
+	std := jwt.Claims{
+		Issuer:    ti.srv.URL,
+		Subject:   "1234",
+		Audience:  jwt.Audience{testAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	token, err := jwt.Signed(signer).Claims(std).Claims(claims).Serialize()
+	if err != nil {
+		ti.t.Fatal(err)
+	}
+	return token
+}
+
+func (ti *testIssuer) authenticator(allowedGroups ...string) *oidcAuthenticator {
+	ti.t.Helper()
+	a, err := newOIDCAuthenticator(&oidcAuthOpts{
+		Issuer:        ti.srv.URL,
+		Audience:      testAudience,
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		AllowedGroups: allowedGroups,
+	})
+	if err != nil {
+		ti.t.Fatal(err)
+	}
+	return a
+}
+
+func TestOIDCAuthenticateValidatesTokens(t *testing.T) {
+	ti := newTestIssuer(t)
+	key := ti.addKey("k1")
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := map[string]any{"preferred_username": "alice"}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{
+			name:  "valid",
+			token: ti.token(key, jose.ES256, "k1", user),
+		},
+		{
+			name:    "missing token",
+			token:   "",
+			wantErr: "missing bearer token",
+		},
+		{
+			name:    "malformed",
+			token:   "not-a-jwt",
+			wantErr: "invalid token",
+		},
+		{
+			name:    "signed by another key",
+			token:   ti.token(other, jose.ES256, "k1", user),
+			wantErr: "invalid token",
+		},
+		{
+			name:    "symmetric algorithm",
+			token:   ti.token([]byte(strings.Repeat("s", 32)), jose.HS256, "k1", user),
+			wantErr: "invalid token",
+		},
+		{
+			name:    "unknown key",
+			token:   ti.token(other, jose.ES256, "k2", user),
+			wantErr: "unknown signing key 'k2'",
+		},
+		{
+			name:    "wrong issuer",
+			token:   ti.token(key, jose.ES256, "k1", map[string]any{"preferred_username": "alice", "iss": "https://evil.example.com"}),
+			wantErr: "invalid issuer",
+		},
+		{
+			name:    "wrong audience",
+			token:   ti.token(key, jose.ES256, "k1", map[string]any{"preferred_username": "alice", "aud": "other"}),
+			wantErr: "invalid audience",
+		},
+		{
+			name:    "expired",
+			token:   ti.token(key, jose.ES256, "k1", map[string]any{"preferred_username": "alice", "exp": now.Add(-time.Hour).Unix()}),
+			wantErr: "token is expired",
+		},
+		{
+			name:    "no expiration",
+			token:   ti.token(key, jose.ES256, "k1", map[string]any{"preferred_username": "alice", "exp": nil}),
+			wantErr: "claim 'exp' missing",
+		},
+		{
+			name:    "not valid yet",
+			token:   ti.token(key, jose.ES256, "k1", map[string]any{"preferred_username": "alice", "nbf": now.Add(time.Hour).Unix()}),
+			wantErr: "not valid yet",
+		},
+		{
+			name:    "missing username",
+			token:   ti.token(key, jose.ES256, "k1", map[string]any{"email": "alice@example.com"}),
+			wantErr: "claim 'preferred_username' missing",
+		},
+		{
+			name:    "username not a string",
+			token:   ti.token(key, jose.ES256, "k1", map[string]any{"preferred_username": 42}),
+			wantErr: "claim 'preferred_username' missing or not a string",
+		},
+	}
+
+	a := ti.authenticator()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := a.Authenticate(context.Background(), tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Authenticate() error = %v", err)
+				}
+				if id.Login != "alice" {
+					t.Errorf("Authenticate() login = %q, want alice", id.Login)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Authenticate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOIDCAuthenticateMapsClaims(t *testing.T) {
+	ti := newTestIssuer(t)
+	key := ti.addKey("k1")
+
+	tests := []struct {
+		name       string
+		allowed    []string
+		claims     map[string]any
+		wantGroups []string
+		wantErr    bool
+	}{
+		{
+			name:       "groups list",
+			claims:     map[string]any{"preferred_username": "alice", "groups": []string{"sre", "dev"}},
+			wantGroups: []string{"sre", "dev"},
+		},
+		{
+			name:       "single group",
+			claims:     map[string]any{"preferred_username": "alice", "groups": "sre"},
+			wantGroups: []string{"sre"},
+		},
+		{
+			name:   "no groups",
+			claims: map[string]any{"preferred_username": "alice"},
+		},
+		{
+			name:       "member of an allowed group",
+			allowed:    []string{"SRE"},
+			claims:     map[string]any{"preferred_username": "alice", "groups": []string{"dev", "sre"}},
+			wantGroups: []string{"dev", "sre"},
+		},
+		{
+			name:    "not a member of the allowed groups",
+			allowed: []string{"sre"},
+			claims:  map[string]any{"preferred_username": "alice", "groups": []string{"dev"}},
+			wantErr: true,
+		},
+		{
+			name:    "no groups with allowed groups",
+			allowed: []string{"sre"},
+			claims:  map[string]any{"preferred_username": "alice"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := ti.authenticator(tt.allowed...).Authenticate(context.Background(), ti.token(key, jose.ES256, "k1", tt.claims))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Authenticate() = %+v, want an error", id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+			want := &identity{Login: "alice", Teams: tt.wantGroups}
+			if !reflect.DeepEqual(id, want) {
+				t.Errorf("Authenticate() = %+v, want %+v", id, want)
+			}
+		})
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	ti := newTestIssuer(t)
+	old := ti.addKey("k1")
+	a := ti.authenticator()
+	ctx := context.Background()
+	user := map[string]any{"preferred_username": "alice"}
+
+	if _, err := a.Authenticate(ctx, ti.token(old, jose.ES256, "k1", user)); err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if _, err := a.Authenticate(ctx, ti.token(old, jose.ES256, "k1", user)); err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if n := ti.fetches(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want the keys to be cached", n)
+	}
+
+	// The issuer rotates its keys
+	current := ti.addKey("k2")
+	ti.removeKey("k1")
+
+	// Unknown keys don't refresh the JWKS more often than jwksRefreshInterval
+	if _, err := a.Authenticate(ctx, ti.token(current, jose.ES256, "k2", user)); err == nil {
+		t.Errorf("Authenticate() accepted a key unknown before the refresh interval")
+	}
+	if n := ti.fetches(); n != 1 {
+		t.Errorf("JWKS fetched %d times before the refresh interval, want 1", n)
+	}
+
+	a.lastRefresh = time.Now().Add(-jwksRefreshInterval)
+	if _, err := a.Authenticate(ctx, ti.token(current, jose.ES256, "k2", user)); err != nil {
+		t.Fatalf("Authenticate() with the new key error = %v", err)
+	}
+	if n := ti.fetches(); n != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", n)
+	}
+
+	// Tokens signed with the removed key are no longer valid
+	if _, err := a.Authenticate(ctx, ti.token(old, jose.ES256, "k1", user)); err == nil {
+		t.Errorf("Authenticate() accepted a token signed with a removed key")
+	}
+}
+
+func TestOIDCDiscoveryChecksIssuer(t *testing.T) {
+	ti := newTestIssuer(t)
+	key := ti.addKey("k1")
+	ti.issuerName = "https://evil.example.com"
+
+	_, err := ti.authenticator().Authenticate(context.Background(), ti.token(key, jose.ES256, "k1", map[string]any{"preferred_username": "alice"}))
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Authenticate() error = %v, want an issuer mismatch", err)
+	}
+}
@@ -0,0 +1,140 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// Permissions that the routes of the API require
+const (
+	permUsersRead     = "users:read"
+	permCRLRead       = "crl:read"
+	permCRLUpdate     = "crl:update"
+	permCRLRotate     = "crl:rotate"
+	permCertsIssue    = "certs:issue"
+	permConfigRead    = "config:read"
+	permUsersRevoke   = "users:revoke"
+	permAPIKeysManage = "apikeys:manage"
+	permAuditRead     = "audit:read"
+	permMetricsRead   = "metrics:read"
+	permStatusRead    = "status:read"
+	permJobsRead      = "jobs:read"
+)
+
+// selfSuffix restricts a permission to the
+// resources of the caller's own user
+const selfSuffix = ":self"
+
+// Roles that can be granted to callers
+const (
+	roleViewer      = "viewer"
+	roleSelfService = "self-service"
+	roleOperator    = "operator"
+	roleAdmin       = "admin"
+)
+
+// rolePermissions are the permissions granted by each role
+var rolePermissions = map[string][]string{
+	roleViewer: {
+		permUsersRead, permCRLRead, permMetricsRead, permStatusRead,
+	},
+	roleSelfService: {
+		permCertsIssue + selfSuffix, permConfigRead + selfSuffix, permJobsRead + selfSuffix,
+	},
+	roleOperator: {
+		permUsersRead, permCRLRead, permCRLUpdate, permCertsIssue, permConfigRead, permMetricsRead, permStatusRead, permJobsRead,
+	},
+	roleAdmin: {
+		permUsersRead, permCRLRead, permCRLUpdate, permCRLRotate, permCertsIssue, permConfigRead, permUsersRevoke, permAPIKeysManage, permAuditRead, permMetricsRead, permStatusRead, permJobsRead,
+	},
+}
+
+// validScope returns true if the value can be used as a scope of an
+// API key. Scopes are the permissions that admins have.
+func validScope(scope string) bool {
+	for _, p := range rolePermissions[roleAdmin] {
+		if scope == p {
+			return true
+		}
+	}
+	return false
+}
+
+// roles returns the roles granted to the caller. If no
+// role mapping is configured, every caller is an admin.
+func (id *identity) roles() []string {
+	if !viper.IsSet("auth-rbac-roles") {
+		return []string{roleAdmin}
+	}
+	roles := []string{}
+	for _, entry := range viper.GetStringSlice("auth-rbac-roles") {
+		subject, role, found := strings.Cut(entry, ":")
+		if found && id.matchesSubject(subject) && !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// permissions returns the permissions of the caller: the scopes
+// of the API key, or the permissions of the caller's roles
+func (id *identity) permissions() []string {
+	if id != nil && id.APIKey != "" {
+		return id.Scopes
+	}
+	perms := []string{}
+	for _, role := range id.roles() {
+		perms = append(perms, rolePermissions[role]...)
+	}
+	return perms
+}
+
+// can returns true if the caller has the permission. Permissions restricted
+// to the caller's own resources are granted when owner is the caller.
+// Usernames are case-sensitive, like the certificate common names.
+// Unauthenticated callers have no permissions if auth is enabled.
+func (id *identity) can(perm string, owner string) bool {
+	if id == nil && authEnabled() {
+		return false
+	}
+	for _, p := range id.permissions() {
+		if p == perm {
+			return true
+		}
+		if id != nil && p == perm+selfSuffix && owner != "" && owner == id.Login {
+			return true
+		}
+	}
+	return false
+}
+
+// requirePermission only lets the request reach the handler if the caller
+// has the given permission. For routes with a {user} variable, permissions
+// restricted to the caller's own resources are also taken into account.
+func requirePermission(perm string, next http.HandlerFunc, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !identityFromRequest(r).can(perm, mux.Vars(r)["user"]) {
+			forbidden(perm, w, r, al, logger)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// forbidden denies the request for lacking the permission
+func forbidden(perm string, w http.ResponseWriter, r *http.Request, al *audit.Logger, logger logr.Logger) {
+	e := newAuditEntry(r, auditDenyRequest)
+	e.Outcome = audit.OutcomeDenied
+	e.User = mux.Vars(r)["user"]
+	e.Details = map[string]string{"permission": perm, "method": r.Method, "path": r.URL.Path}
+	al.Record(r.Context(), e)
+	reportHttpError("forbidden", fmt.Errorf("permission '%s' required", perm),
+		http.StatusForbidden, w, logger)
+}
@@ -0,0 +1,36 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestCanDeniesAnonymousWhenAuthEnabled(t *testing.T) {
+	defer viper.Reset()
+
+	var id *identity
+	if !id.can(permUsersRevoke, "") {
+		t.Errorf("anonymous caller denied without auth")
+	}
+	viper.Set("auth-github-org", "acme")
+	if id.can(permUsersRevoke, "") {
+		t.Errorf("anonymous caller allowed with auth enabled")
+	}
+}
+
+func TestCanSelfIsCaseSensitive(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("auth-github-org", "acme")
+	viper.Set("auth-rbac-roles", []string{"user/alice:self-service"})
+
+	id := &identity{Login: "alice"}
+	if !id.can(permCertsIssue, "alice") {
+		t.Errorf("alice can't issue their own certificates")
+	}
+	for _, owner := range []string{"Alice", "ALICE", "bob", ""} {
+		if id.can(permCertsIssue, owner) {
+			t.Errorf("alice can issue certificates of %q", owner)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"strings"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/ha"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/go-logr/logr"
+	"github.com/google/go-github/github"
+	"github.com/spf13/viper"
+)
+
+// reconcileUsers revokes (or flags, in dry-run mode) the VPN users
+// that are no longer allowed by the GitHub auth configuration
+func reconcileUsers(ctx context.Context, vc vault.AuthenticatedClient, al *audit.Logger, mutations *ha.Lock, logger logr.Logger) error {
+	unlock, err := lockMutations(ctx, mutations)
+	if err != nil {
+		logger.Error(err, "Unable to acquire the mutations lock")
+		return err
+	}
+	defer unlock()
+
+	client, err := vc.GetClient(logger)
+	if err != nil {
+		logger.Error(err, "Failed while creating Vault client")
+		return err
+	}
+
+	members, err := githubMembers(ctx, &githubAuthOpts{
+		Token:        viper.GetString("github-reconcile-token"),
+		Organization: viper.GetString("auth-github-org"),
+		AllowedUsers: viper.GetStringSlice("auth-github-users"),
+		AllowedTeams: viper.GetStringSlice("auth-github-teams"),
+		BaseURL:      viper.GetString("auth-github-base-url"),
+	})
+	if err != nil {
+		logger.Error(err, "Cron procesor failed trying to retrieve GitHub members")
+		return err
+	}
+
+	rsp, err := operations.ReconcileUsers(ctx,
+		&operations.ReconcileUsersRequest{
+			Client:              client,
+			VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+			VaultKVPath:         viper.GetString("vault-kv-path"),
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			Members:             members,
+			DryRun:              viper.GetBool("github-reconcile-dry-run"),
+			MaxRevocations:      viper.GetInt("crl-max-revocations"),
+		}, logger.WithValues("operation", "reconcileUsers"))
+	if rsp != nil {
+		for _, username := range rsp.Revoked {
+			e := newSystemAuditEntry(auditRevokeUser, "reconcile")
+			e.User = username
+			e.Details = map[string]string{"reason": "not allowed by the GitHub auth configuration"}
+			al.Record(ctx, e)
+		}
+	}
+	if err != nil {
+		e := newSystemAuditEntry(auditRevokeUser, "reconcile")
+		al.Record(ctx, auditResult(e, err))
+		logger.Error(err, "Cron procesor failed trying to reconcile users")
+		return err
+	}
+	logger.Info("Users reconciled with GitHub membership by cron processor",
+		"flagged", rsp.Flagged, "revoked", rsp.Revoked)
+	return nil
+}
+
+// githubMembers returns the logins of all the GitHub users that would
+// be granted access by githubAuth with the same options. The token needs
+// to be able to read the organization and team memberships.
+func githubMembers(ctx context.Context, gh *githubAuthOpts) ([]string, error) {
+
+	client, err := newGithubClient(ctx, gh)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get all the members of the organization
+	orgMembers := map[string]string{}
+	memberOpt := &github.ListMembersOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		users, resp, err := client.Organizations.ListMembers(ctx, gh.Organization, memberOpt)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			orgMembers[strings.ToLower(*u.Login)] = *u.Login
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		memberOpt.Page = resp.NextPage
+	}
+
+	// If neither AllowedTeams not AllowedUsers is set, any user
+	// that belongs to the organization is allowed
+	if len(gh.AllowedTeams) == 0 && len(gh.AllowedUsers) == 0 {
+		members := []string{}
+		for _, login := range orgMembers {
+			members = append(members, login)
+		}
+		return members, nil
+	}
+
+	allowed := map[string]string{}
+	for _, u := range gh.AllowedUsers {
+		if login, ok := orgMembers[strings.ToLower(u)]; ok {
+			allowed[strings.ToLower(u)] = login
+		}
+	}
+
+	if len(gh.AllowedTeams) != 0 {
+		teamOpt := &github.ListOptions{
+			PerPage: 100,
+		}
+		var allTeams []*github.Team
+		for {
+			teams, resp, err := client.Teams.ListTeams(ctx, gh.Organization, teamOpt)
+			if err != nil {
+				return nil, err
+			}
+			allTeams = append(allTeams, teams...)
+			if resp.NextPage == 0 {
+				break
+			}
+			teamOpt.Page = resp.NextPage
+		}
+
+		for _, t := range allTeams {
+			if !teamAllowed(t, gh.AllowedTeams) {
+				continue
+			}
+			teamMemberOpt := &github.TeamListTeamMembersOptions{
+				ListOptions: github.ListOptions{PerPage: 100},
+			}
+			for {
+				users, resp, err := client.Teams.ListTeamMembers(ctx, *t.ID, teamMemberOpt)
+				if err != nil {
+					return nil, err
+				}
+				for _, u := range users {
+					if login, ok := orgMembers[strings.ToLower(*u.Login)]; ok {
+						allowed[strings.ToLower(login)] = login
+					}
+				}
+				if resp.NextPage == 0 {
+					break
+				}
+				teamMemberOpt.Page = resp.NextPage
+			}
+		}
+	}
+
+	members := []string{}
+	for _, login := range allowed {
+		members = append(members, login)
+	}
+	return members, nil
+}
+
+// teamAllowed returns true if either the name or the
+// slug of the team is in the list of allowed teams
+func teamAllowed(t *github.Team, allowedTeams []string) bool {
+	for _, at := range allowedTeams {
+		if strings.EqualFold(t.GetName(), at) || strings.EqualFold(t.GetSlug(), at) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,27 +2,32 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"regexp"
-	"strings"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/jobs"
 	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/tracing"
 	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
-	"github.com/google/go-github/github"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/robfig/cron"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
-	"golang.org/x/oauth2"
 )
 
 // serverOptions is the options for the command
@@ -41,6 +46,45 @@ type serverOptions struct {
 	AuthGithubOrg               string
 	AuthGithubUsers             []string
 	AuthGithubTeams             []string
+	AuthGithubBaseURL           string
+	AuthCacheTTL                time.Duration
+	AuthCacheMaxStale           time.Duration
+	AuthMTLSPKIRole             string
+	TLSCertFile                 string
+	TLSKeyFile                  string
+	AuthOIDCIssuer              string
+	AuthOIDCJWKSURL             string
+	AuthOIDCAudience            string
+	AuthOIDCUsernameClaim       string
+	AuthOIDCGroupsClaim         string
+	AuthOIDCGroups              []string
+	GithubReconcileToken        string
+	GithubReconcileSchedule     string
+	GithubReconcileDryRun       bool
+	CRLWatchdogSchedule         string
+	CRLRotationThreshold        time.Duration
+	CRLAlertThreshold           time.Duration
+	CRLRotationRetries          int
+	NotifyWebhookURL            string
+	CRLMaxRevocations           int
+	MaxGracePeriod              time.Duration
+	MaxDevicesPerUser           int
+	AuthPKIRoles                []string
+	AuthRBACRoles               []string
+	AuditSinks                  []string
+	TracingOTLPEndpoint         string
+	TracingOTLPProtocol         string
+	TracingOTLPInsecure         bool
+	TracingSampleRatio          float64
+	VaultAPITimeout             time.Duration
+	AWSAPITimeout               time.Duration
+	RequestTimeout              time.Duration
+	ShutdownTimeout             time.Duration
+	HAEnabled                   bool
+	HALockTTL                   time.Duration
+	HAReplicaID                 string
+	JobsRetention               time.Duration
+	CertIndexPersist            bool
 	LogMode                     string
 }
 
@@ -69,6 +113,12 @@ func init() {
 	viper.BindPFlag("port", serverCmd.Flags().Lookup("port"))
 	viper.SetDefault("port", "8080")
 
+	serverCmd.Flags().StringVar(&serverOpts.TLSCertFile, "tls-cert-file", "", "The certificate file used to serve TLS. The file is reloaded when it changes")
+	viper.BindPFlag("tls-cert-file", serverCmd.Flags().Lookup("tls-cert-file"))
+
+	serverCmd.Flags().StringVar(&serverOpts.TLSKeyFile, "tls-key-file", "", "The private key file of the TLS certificate")
+	viper.BindPFlag("tls-key-file", serverCmd.Flags().Lookup("tls-key-file"))
+
 	// AWS Client VPN endpoint
 	serverCmd.Flags().StringVar(&serverOpts.clientVPNEndpointID, "client-vpn-endpoint-id", "", "The AWS Client VPN endpoint ID")
 	viper.BindPFlag("client-vpn-endpoint-id", serverCmd.Flags().Lookup("client-vpn-endpoint-id"))
@@ -117,6 +167,144 @@ func init() {
 
 	serverCmd.Flags().StringSliceVar(&serverOpts.AuthGithubUsers, "auth-github-users", []string{}, "The GitHub users allowed to access the server")
 	viper.BindPFlag("auth-github-users", serverCmd.Flags().Lookup("auth-github-users"))
+
+	serverCmd.Flags().StringVar(&serverOpts.AuthGithubBaseURL, "auth-github-base-url", "", "The API URL of a GitHub Enterprise server, like https://github.example.com/api/v3/. Uses github.com if not set")
+	viper.BindPFlag("auth-github-base-url", serverCmd.Flags().Lookup("auth-github-base-url"))
+
+	serverCmd.Flags().DurationVar(&serverOpts.AuthCacheTTL, "auth-cache-ttl", 0, "How long the identity resolved for a GitHub token is cached. 0 disables the cache")
+	viper.BindPFlag("auth-cache-ttl", serverCmd.Flags().Lookup("auth-cache-ttl"))
+	viper.SetDefault("auth-cache-ttl", "5m")
+
+	serverCmd.Flags().DurationVar(&serverOpts.AuthCacheMaxStale, "auth-cache-max-stale", 0, "How long expired auth cache entries are still served while GitHub is rate limiting requests. 0 never serves them")
+	viper.BindPFlag("auth-cache-max-stale", serverCmd.Flags().Lookup("auth-cache-max-stale"))
+	viper.SetDefault("auth-cache-max-stale", "0")
+
+	// mTLS auth related options
+	serverCmd.Flags().StringVar(&serverOpts.AuthMTLSPKIRole, "auth-mtls-pki-role", "", "Authenticate callers by client certificates issued by this role of the Vault PKI. Requires TLS")
+	viper.BindPFlag("auth-mtls-pki-role", serverCmd.Flags().Lookup("auth-mtls-pki-role"))
+
+	// OIDC auth related options
+	serverCmd.Flags().StringVar(&serverOpts.AuthOIDCIssuer, "auth-oidc-issuer", "", "The OIDC issuer whose JWT bearer tokens are accepted. Cannot be used together with GitHub auth")
+	viper.BindPFlag("auth-oidc-issuer", serverCmd.Flags().Lookup("auth-oidc-issuer"))
+
+	serverCmd.Flags().StringVar(&serverOpts.AuthOIDCJWKSURL, "auth-oidc-jwks-url", "", "The URL of the issuer's signing keys. Discovered from the issuer if not set")
+	viper.BindPFlag("auth-oidc-jwks-url", serverCmd.Flags().Lookup("auth-oidc-jwks-url"))
+
+	serverCmd.Flags().StringVar(&serverOpts.AuthOIDCAudience, "auth-oidc-audience", "", "The audience the tokens must be issued for")
+	viper.BindPFlag("auth-oidc-audience", serverCmd.Flags().Lookup("auth-oidc-audience"))
+
+	serverCmd.Flags().StringVar(&serverOpts.AuthOIDCUsernameClaim, "auth-oidc-username-claim", "", "The token claim used as username")
+	viper.BindPFlag("auth-oidc-username-claim", serverCmd.Flags().Lookup("auth-oidc-username-claim"))
+	viper.SetDefault("auth-oidc-username-claim", "preferred_username")
+
+	serverCmd.Flags().StringVar(&serverOpts.AuthOIDCGroupsClaim, "auth-oidc-groups-claim", "", "The token claim with the groups of the user")
+	viper.BindPFlag("auth-oidc-groups-claim", serverCmd.Flags().Lookup("auth-oidc-groups-claim"))
+	viper.SetDefault("auth-oidc-groups-claim", "groups")
+
+	serverCmd.Flags().StringSliceVar(&serverOpts.AuthOIDCGroups, "auth-oidc-groups", []string{}, "The OIDC groups allowed to access the server")
+	viper.BindPFlag("auth-oidc-groups", serverCmd.Flags().Lookup("auth-oidc-groups"))
+
+	// Authorization options
+	serverCmd.Flags().StringSliceVar(&serverOpts.AuthPKIRoles, "auth-pki-roles", []string{}, "The Vault PKI roles each caller may request, as '<subject>:<role>' entries. Subjects can be 'user/<login>', 'team/<team>' or '*'")
+	viper.BindPFlag("auth-pki-roles", serverCmd.Flags().Lookup("auth-pki-roles"))
+
+	serverCmd.Flags().StringSliceVar(&serverOpts.AuthRBACRoles, "auth-rbac-roles", []string{}, "The API roles (viewer, self-service, operator, admin) granted to each caller, as '<subject>:<role>' entries. If unset, every allowed caller is an admin")
+	viper.BindPFlag("auth-rbac-roles", serverCmd.Flags().Lookup("auth-rbac-roles"))
+
+	// Audit options
+	serverCmd.Flags().StringSliceVar(&serverOpts.AuditSinks, "audit-sinks", []string{}, "Where the audit log is stored: 'file:<path>', 'vault' (in the kv store) or 'webhook:<url>'. Entries are always written to the log")
+	viper.BindPFlag("audit-sinks", serverCmd.Flags().Lookup("audit-sinks"))
+
+	// Timeout options
+	serverCmd.Flags().DurationVar(&serverOpts.VaultAPITimeout, "vault-api-timeout", config.VaultApiTimeout, "The timeout of each call to Vault")
+	viper.BindPFlag("vault-api-timeout", serverCmd.Flags().Lookup("vault-api-timeout"))
+	viper.SetDefault("vault-api-timeout", config.VaultApiTimeout)
+	serverCmd.Flags().DurationVar(&serverOpts.AWSAPITimeout, "aws-api-timeout", config.AwsApiTimeout, "The timeout of each call to the AWS API")
+	viper.BindPFlag("aws-api-timeout", serverCmd.Flags().Lookup("aws-api-timeout"))
+	viper.SetDefault("aws-api-timeout", config.AwsApiTimeout)
+	serverCmd.Flags().DurationVar(&serverOpts.RequestTimeout, "request-timeout", 5*time.Minute, "The deadline of the operation of each API request. 0 means no deadline")
+	viper.BindPFlag("request-timeout", serverCmd.Flags().Lookup("request-timeout"))
+	viper.SetDefault("request-timeout", "5m")
+	serverCmd.Flags().DurationVar(&serverOpts.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "How long the server waits for the in-flight requests and cron jobs when stopping")
+	viper.BindPFlag("shutdown-timeout", serverCmd.Flags().Lookup("shutdown-timeout"))
+	viper.SetDefault("shutdown-timeout", "30s")
+
+	// HA options
+	hostname, _ := os.Hostname()
+	serverCmd.Flags().BoolVar(&serverOpts.HAEnabled, "ha-enabled", false, "Run several replicas. A leader elected with a lock in the kv store runs the scheduled jobs, and changes are serialized across replicas")
+	viper.BindPFlag("ha-enabled", serverCmd.Flags().Lookup("ha-enabled"))
+	serverCmd.Flags().DurationVar(&serverOpts.HALockTTL, "ha-lock-ttl", 30*time.Second, "How long the HA locks last if their holder stops renewing them")
+	viper.BindPFlag("ha-lock-ttl", serverCmd.Flags().Lookup("ha-lock-ttl"))
+	viper.SetDefault("ha-lock-ttl", "30s")
+	serverCmd.Flags().StringVar(&serverOpts.HAReplicaID, "ha-replica-id", hostname, "The unique name of this replica in the HA locks. Defaults to the hostname")
+	viper.BindPFlag("ha-replica-id", serverCmd.Flags().Lookup("ha-replica-id"))
+	viper.SetDefault("ha-replica-id", hostname)
+
+	// Job options
+	serverCmd.Flags().DurationVar(&serverOpts.JobsRetention, "jobs-retention", 7*24*time.Hour, "How long the background and cron jobs are kept in the job history")
+	viper.BindPFlag("jobs-retention", serverCmd.Flags().Lookup("jobs-retention"))
+	viper.SetDefault("jobs-retention", "168h")
+
+	// Certificate index options
+	serverCmd.Flags().BoolVar(&serverOpts.CertIndexPersist, "cert-index-persist", false, "Persist the index of the PKI certificates in the kv store, so it doesn't have to be rebuilt on restarts")
+	viper.BindPFlag("cert-index-persist", serverCmd.Flags().Lookup("cert-index-persist"))
+
+	// Tracing options
+	serverCmd.Flags().StringVar(&serverOpts.TracingOTLPEndpoint, "tracing-otlp-endpoint", "", "The host:port of the OTLP collector the traces are sent to. Enables tracing")
+	viper.BindPFlag("tracing-otlp-endpoint", serverCmd.Flags().Lookup("tracing-otlp-endpoint"))
+	serverCmd.Flags().StringVar(&serverOpts.TracingOTLPProtocol, "tracing-otlp-protocol", "grpc", "The protocol used to send the traces: 'grpc' or 'http/protobuf'")
+	viper.BindPFlag("tracing-otlp-protocol", serverCmd.Flags().Lookup("tracing-otlp-protocol"))
+	viper.SetDefault("tracing-otlp-protocol", "grpc")
+	serverCmd.Flags().BoolVar(&serverOpts.TracingOTLPInsecure, "tracing-otlp-insecure", false, "Send the traces to the collector without TLS")
+	viper.BindPFlag("tracing-otlp-insecure", serverCmd.Flags().Lookup("tracing-otlp-insecure"))
+	serverCmd.Flags().Float64Var(&serverOpts.TracingSampleRatio, "tracing-sample-ratio", 1, "The fraction of the traces that are sampled, unless the caller already decided it")
+	viper.BindPFlag("tracing-sample-ratio", serverCmd.Flags().Lookup("tracing-sample-ratio"))
+	viper.SetDefault("tracing-sample-ratio", 1)
+
+	// GitHub membership reconciliation options
+	serverCmd.Flags().StringVar(&serverOpts.GithubReconcileToken, "github-reconcile-token", "", "GitHub token with read access to the org and team memberships. Enables the periodic revocation of users that are no longer allowed by the GitHub auth options")
+	viper.BindPFlag("github-reconcile-token", serverCmd.Flags().Lookup("github-reconcile-token"))
+
+	serverCmd.Flags().StringVar(&serverOpts.GithubReconcileSchedule, "github-reconcile-schedule", "", "The cron schedule of the GitHub membership reconciliation")
+	viper.BindPFlag("github-reconcile-schedule", serverCmd.Flags().Lookup("github-reconcile-schedule"))
+	viper.SetDefault("github-reconcile-schedule", "@hourly")
+
+	serverCmd.Flags().BoolVar(&serverOpts.GithubReconcileDryRun, "github-reconcile-dry-run", true, "Only flag the users that are no longer allowed instead of revoking them")
+	viper.BindPFlag("github-reconcile-dry-run", serverCmd.Flags().Lookup("github-reconcile-dry-run"))
+	viper.SetDefault("github-reconcile-dry-run", true)
+
+	// CRL watchdog options
+	serverCmd.Flags().StringVar(&serverOpts.CRLWatchdogSchedule, "crl-watchdog-schedule", "", "The cron schedule of the CRL expiry checks")
+	viper.BindPFlag("crl-watchdog-schedule", serverCmd.Flags().Lookup("crl-watchdog-schedule"))
+	viper.SetDefault("crl-watchdog-schedule", "@every 10m")
+
+	serverCmd.Flags().DurationVar(&serverOpts.CRLRotationThreshold, "crl-rotation-threshold", 0, "Rotate the CRL when its remaining lifetime drops below this value")
+	viper.BindPFlag("crl-rotation-threshold", serverCmd.Flags().Lookup("crl-rotation-threshold"))
+	viper.SetDefault("crl-rotation-threshold", "24h")
+
+	serverCmd.Flags().DurationVar(&serverOpts.CRLAlertThreshold, "crl-alert-threshold", 0, "Send an alert when the remaining lifetime of the CRL drops below this value")
+	viper.BindPFlag("crl-alert-threshold", serverCmd.Flags().Lookup("crl-alert-threshold"))
+	viper.SetDefault("crl-alert-threshold", "12h")
+
+	serverCmd.Flags().IntVar(&serverOpts.CRLRotationRetries, "crl-rotation-retries", 0, "How many times a failed CRL rotation is retried by the CRL watchdog")
+	viper.BindPFlag("crl-rotation-retries", serverCmd.Flags().Lookup("crl-rotation-retries"))
+	viper.SetDefault("crl-rotation-retries", 5)
+
+	serverCmd.Flags().IntVar(&serverOpts.CRLMaxRevocations, "crl-max-revocations", 0, "Maximum number of certificates that a single CRL update can revoke unless explicitly overridden. 0 means no limit")
+	viper.BindPFlag("crl-max-revocations", serverCmd.Flags().Lookup("crl-max-revocations"))
+	viper.SetDefault("crl-max-revocations", 10)
+
+	serverCmd.Flags().DurationVar(&serverOpts.MaxGracePeriod, "max-grace-period", 0, "The longest grace period that can be requested when issuing a certificate")
+	viper.BindPFlag("max-grace-period", serverCmd.Flags().Lookup("max-grace-period"))
+	viper.SetDefault("max-grace-period", "72h")
+
+	serverCmd.Flags().IntVar(&serverOpts.MaxDevicesPerUser, "max-devices-per-user", 0, "Maximum number of devices with an active certificate a user can have. 0 means no limit")
+	viper.BindPFlag("max-devices-per-user", serverCmd.Flags().Lookup("max-devices-per-user"))
+	viper.SetDefault("max-devices-per-user", 3)
+
+	// Notification options
+	serverCmd.Flags().StringVar(&serverOpts.NotifyWebhookURL, "notify-webhook-url", "", "Webhook URL where alerts are posted (Slack compatible). Alerts are always logged")
+	viper.BindPFlag("notify-webhook-url", serverCmd.Flags().Lookup("notify-webhook-url"))
 }
 
 func initConfig() {
@@ -173,6 +361,12 @@ func runServer(cmd *cobra.Command, args []string) {
 		log.Panicf("unkown log mode %s", mode)
 	}
 
+	config.VaultApiTimeout = viper.GetDuration("vault-api-timeout")
+	config.AwsApiTimeout = viper.GetDuration("aws-api-timeout")
+	if viper.GetBool("cert-index-persist") {
+		config.CertIndexKVPath = viper.GetString("vault-kv-path")
+	}
+
 	var vc vault.AuthenticatedClient
 	if viper.IsSet("vault-auth-token") {
 		vc = &vault.TokenAuthenticatedClient{
@@ -202,51 +396,327 @@ func runServer(cmd *cobra.Command, args []string) {
 
 func start(vc vault.AuthenticatedClient, logger logr.Logger) {
 
+	// ctx is cancelled when a termination signal is received. Cron jobs
+	// in flight stop at the next call, unless they are already revoking
+	// certificates, which is always completed.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, &tracing.Options{
+		Endpoint:    viper.GetString("tracing-otlp-endpoint"),
+		Protocol:    viper.GetString("tracing-otlp-protocol"),
+		Insecure:    viper.GetBool("tracing-otlp-insecure"),
+		SampleRatio: viper.GetFloat64("tracing-sample-ratio"),
+	})
+	if err != nil {
+		log.Panicf("Invalid tracing config: %s", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	al, err := newAuditLogger(vc, logger)
+	if err != nil {
+		log.Panicf("Invalid audit config: %s", err)
+	}
+
+	// In HA mode, only the leader runs the cron jobs, and
+	// changes are serialized across replicas with a lock
+	elector, mutations := newHA(vc, logger)
+	electionCtx, stopElection := context.WithCancel(context.Background())
+	elected := make(chan struct{})
+	if elector != nil {
+		go func() {
+			defer close(elected)
+			elector.Run(electionCtx)
+		}()
+	} else {
+		close(elected)
+	}
+
+	// The history of the background jobs and of the cron jobs
+	jm := jobs.NewManager(jobs.NewVaultStore(vc, viper.GetString("vault-kv-path"), logger), logger)
+
 	// Start RotateCRL cron like task
 	c := cron.New()
-	c.AddFunc("@daily", func() {
+	scheduled := &jobGroup{elector: elector, history: jm, logger: logger}
+	c.AddFunc("@daily", scheduled.wrap(ctx, cronRotateCRL, func(ctx context.Context, logger logr.Logger) error {
+		unlock, err := lockMutations(ctx, mutations)
+		if err != nil {
+			logger.Error(err, "Unable to acquire the mutations lock")
+			return err
+		}
+		defer unlock()
+
 		client, err := vc.GetClient(logger)
 		if err != nil {
 			log.Panic("Failed while creating Vault client")
 		}
-		_, err = operations.RotateCRL(
+		rsp, err := operations.RotateCRL(ctx,
 			&operations.RotateCRLRequest{
 				Client:              client,
 				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
 				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				MaxRevocations:      viper.GetInt("crl-max-revocations"),
 			}, logger.WithValues("operation", "rotateCRL"))
+		if err == nil {
+			err = rsp.LimitError()
+		}
+		e := newSystemAuditEntry(auditRotateCRL, "cron")
+		if rsp != nil {
+			e.Serials = rsp.Revoked
+		}
+		al.Record(ctx, auditResult(e, err))
 		if err != nil {
 			logger.Error(err, "Cron procesor failed trying to rotate the CRL")
-		} else {
-			logger.Info("Vault CRL rotated by cron processor")
+			return err
 		}
-	})
+		logger.Info("Vault CRL rotated by cron processor")
+		return nil
+	}))
+
+	// Revoke the certificates whose grace period has ended
+	c.AddFunc("@every 5m", scheduled.wrap(ctx, cronPendingRevocations, func(ctx context.Context, logger logr.Logger) error {
+		unlock, err := lockMutations(ctx, mutations)
+		if err != nil {
+			logger.Error(err, "Unable to acquire the mutations lock")
+			return err
+		}
+		defer unlock()
+
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			logger.Error(err, "Failed while creating Vault client")
+			return err
+		}
+		revoked, err := operations.ProcessPendingRevocations(ctx,
+			&operations.ProcessPendingRevocationsRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				MaxRevocations:      viper.GetInt("crl-max-revocations"),
+			}, logger.WithValues("operation", "processPendingRevocations"))
+		for _, pr := range revoked {
+			e := newSystemAuditEntry(auditRevokeCertificate, "cron")
+			e.User, e.Device, e.Serials = pr.Username, pr.Device, []string{pr.SerialNumber}
+			e.Details = map[string]string{"reason": "grace period ended"}
+			al.Record(ctx, e)
+		}
+		if err != nil {
+			al.Record(ctx, auditResult(newSystemAuditEntry(auditRevokeCertificate, "cron"), err))
+			logger.Error(err, "Cron procesor failed trying to process pending revocations")
+			return err
+		}
+		if len(revoked) > 0 {
+			logger.Info(fmt.Sprintf("%d pending revocations processed by cron processor", len(revoked)))
+		}
+		return nil
+	}))
+
+	// Revoke the users whose access has ended
+	c.AddFunc("@every 5m", scheduled.wrap(ctx, cronAccessExpirations, func(ctx context.Context, logger logr.Logger) error {
+		unlock, err := lockMutations(ctx, mutations)
+		if err != nil {
+			logger.Error(err, "Unable to acquire the mutations lock")
+			return err
+		}
+		defer unlock()
+
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			logger.Error(err, "Failed while creating Vault client")
+			return err
+		}
+		expired, err := operations.ProcessAccessExpirations(ctx,
+			&operations.ProcessAccessExpirationsRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				MaxRevocations:      viper.GetInt("crl-max-revocations"),
+			}, logger.WithValues("operation", "processAccessExpirations"))
+		for _, ae := range expired {
+			e := newSystemAuditEntry(auditRevokeUser, "cron")
+			e.User = ae.Username
+			e.Details = map[string]string{"reason": "access expired", "expiresAt": ae.ExpiresAt.Format(time.RFC3339)}
+			al.Record(ctx, e)
+		}
+		if err != nil {
+			al.Record(ctx, auditResult(newSystemAuditEntry(auditRevokeUser, "cron"), err))
+			logger.Error(err, "Cron procesor failed trying to process access expirations")
+			return err
+		}
+		if len(expired) > 0 {
+			logger.Info(fmt.Sprintf("%d access expirations processed by cron processor", len(expired)))
+		}
+		return nil
+	}))
+
+	// Periodically refresh the last-seen timestamps, so dormant
+	// accounts can be detected even if nobody queries the API
+	c.AddFunc("@every 15m", scheduled.wrap(ctx, cronUserActivity, func(ctx context.Context, logger logr.Logger) error {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			logger.Error(err, "Failed while creating Vault client")
+			return err
+		}
+		err = operations.RefreshUserActivity(ctx,
+			&operations.ListUserActivityRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			}, logger.WithValues("operation", "refreshUserActivity"))
+		if err != nil {
+			logger.Error(err, "Cron procesor failed trying to refresh user activity")
+			return err
+		}
+		return nil
+	}))
+
+	// Revoke users that have left the GitHub org or allowed teams
+	if viper.IsSet("auth-github-org") && viper.IsSet("github-reconcile-token") {
+		err := c.AddFunc(viper.GetString("github-reconcile-schedule"), scheduled.wrap(ctx, cronGithubReconcile, func(ctx context.Context, logger logr.Logger) error {
+			return reconcileUsers(ctx, vc, al, mutations, logger)
+		}))
+		if err != nil {
+			log.Panicf("Invalid github-reconcile-schedule: %s", err)
+		}
+	}
+
+	// Watch the CRL expiry
+	wd := newCRLWatchdog(vc, al, mutations, logger)
+	if err := c.AddFunc(viper.GetString("crl-watchdog-schedule"), scheduled.wrap(ctx, cronCRLWatchdog, wd.run)); err != nil {
+		log.Panicf("Invalid crl-watchdog-schedule: %s", err)
+	}
+
+	// Remove the old jobs from the history
+	c.AddFunc("@daily", scheduled.wrap(ctx, cronPruneJobs, func(ctx context.Context, logger logr.Logger) error {
+		pruned, err := jm.Prune(ctx, time.Now().Add(-viper.GetDuration("jobs-retention")))
+		if err != nil {
+			logger.Error(err, "Cron procesor failed trying to prune the job history")
+			return err
+		}
+		if pruned > 0 {
+			logger.Info(fmt.Sprintf("%d jobs pruned from the job history by cron processor", pruned))
+		}
+		return nil
+	}))
 	c.Start()
 
 	// Start the server
 	mux := mux.NewRouter()
-	mux.HandleFunc("/crl", getCRLHandler(vc, logger)).Methods(http.MethodGet)
-	mux.HandleFunc("/crl", updateCRLHandler(vc, logger)).Methods(http.MethodPost)
-	mux.HandleFunc("/crl/rotate", rotateCRLHandler(vc, logger)).Methods(http.MethodPost)
-	mux.HandleFunc("/issue/{user}", issueClientCertificateHandler(vc, logger)).Methods(http.MethodPost)
-	mux.HandleFunc("/revoke/{user}", revokeUserHandler(vc, logger)).Methods(http.MethodPost)
-	mux.HandleFunc("/users", listUsersHandler(vc, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/crl", requirePermission(permCRLRead, getCRLHandler(vc, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/crl", requirePermission(permCRLUpdate, asyncHandler(ctx, auditUpdateCRL, updateCRLHandler(vc, al, logger), jm, mutations, logger), al, logger)).Methods(http.MethodPost)
+	mux.HandleFunc("/crl/rotate", requirePermission(permCRLRotate, asyncHandler(ctx, auditRotateCRL, rotateCRLHandler(vc, al, logger), jm, mutations, logger), al, logger)).Methods(http.MethodPost)
+	mux.HandleFunc("/crl/status", requirePermission(permCRLRead, getCRLStatusHandler(vc, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/crl/preview", requirePermission(permCRLRead, previewUpdateCRLHandler(vc, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/issue/{user}", requirePermission(permCertsIssue, asyncHandler(ctx, auditIssueCertificate, issueClientCertificateHandler(vc, al, logger), jm, mutations, logger), al, logger)).Methods(http.MethodPost)
+	mux.HandleFunc("/issue/{user}/devices/{device}", requirePermission(permCertsIssue, asyncHandler(ctx, auditIssueCertificate, issueClientCertificateHandler(vc, al, logger), jm, mutations, logger), al, logger)).Methods(http.MethodPost)
+	mux.HandleFunc("/revoke/{user}", requirePermission(permUsersRevoke, asyncHandler(ctx, auditRevokeUser, revokeUserHandler(vc, al, logger), jm, mutations, logger), al, logger)).Methods(http.MethodPost)
+	mux.HandleFunc("/revoke/{user}/devices/{device}", requirePermission(permUsersRevoke, asyncHandler(ctx, auditRevokeDevice, revokeDeviceHandler(vc, al, logger), jm, mutations, logger), al, logger)).Methods(http.MethodPost)
+	mux.HandleFunc("/expirations", requirePermission(permUsersRead, listAccessExpirationsHandler(vc, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/expirations/{user}", requirePermission(permUsersRevoke, cancelAccessExpirationHandler(vc, al, logger), al, logger)).Methods(http.MethodDelete)
+	mux.HandleFunc("/revocations/pending", requirePermission(permUsersRead, listPendingRevocationsHandler(vc, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/users", requirePermission(permUsersRead, listUsersHandler(vc, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/users/{user}/devices", requirePermission(permUsersRead, listUserDevicesHandler(vc, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/users/{user}/config", requirePermission(permConfigRead, getClientConfigHandler(vc, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/users/{user}/devices/{device}/config", requirePermission(permConfigRead, getClientConfigHandler(vc, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/me/issue", selfService(requirePermission(permCertsIssue, asyncHandler(ctx, auditIssueCertificate, issueClientCertificateHandler(vc, al, logger), jm, mutations, logger), al, logger), logger)).Methods(http.MethodPost)
+	mux.HandleFunc("/me/issue/devices/{device}", selfService(requirePermission(permCertsIssue, asyncHandler(ctx, auditIssueCertificate, issueClientCertificateHandler(vc, al, logger), jm, mutations, logger), al, logger), logger)).Methods(http.MethodPost)
+	mux.HandleFunc("/me/config", selfService(requirePermission(permConfigRead, getClientConfigHandler(vc, logger), al, logger), logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/me/devices/{device}/config", selfService(requirePermission(permConfigRead, getClientConfigHandler(vc, logger), al, logger), logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/activity", requirePermission(permUsersRead, listUserActivityHandler(vc, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/apikeys", requirePermission(permAPIKeysManage, listAPIKeysHandler(vc, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/apikeys", requirePermission(permAPIKeysManage, createAPIKeyHandler(vc, al, logger), al, logger)).Methods(http.MethodPost)
+	mux.HandleFunc("/apikeys/{id}", requirePermission(permAPIKeysManage, revokeAPIKeyHandler(vc, al, logger), al, logger)).Methods(http.MethodDelete)
+	mux.HandleFunc("/audit", requirePermission(permAuditRead, queryAuditHandler(al, logger), al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/audit/verify", requirePermission(permAuditRead, verifyAuditHandler(al, logger), al, logger)).Methods(http.MethodGet)
+	mux.Handle("/metrics", requirePermission(permMetricsRead, promhttp.Handler().ServeHTTP, al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/jobs", listJobsHandler(jm, al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/jobs/{id}", getJobHandler(jm, al, logger)).Methods(http.MethodGet)
+	mux.HandleFunc("/ha/status", requirePermission(permStatusRead, haStatusHandler(elector, logger), al, logger)).Methods(http.MethodGet)
 	mux.HandleFunc("/healthz", healthzHandler(vc, logger)).Methods(http.MethodGet)
 	mux.HandleFunc("/readyz", readyzHandler()).Methods(http.MethodGet)
 	// Add a logging middleware
 	loggedRouter := handlers.CombinedLoggingHandler(os.Stdout, mux)
 
+	auth, err := newAuthenticator(vc, logger)
+	if err != nil {
+		log.Panicf("Invalid auth config: %s", err)
+	}
+	mtls, err := newMTLSAuthenticator(vc, logger)
+	if err != nil {
+		log.Panicf("Invalid mTLS auth config: %s", err)
+	}
+
+	srv := &http.Server{
+		Addr:    ":" + viper.GetString("port"),
+		Handler: instrumentHandler(requestTimeout(authMiddleware(serializeMutations(loggedRouter, mutations, logger), auth, mtls, al, logger), viper.GetDuration("request-timeout")), mux),
+	}
+
 	// Start the server
-	if err := http.ListenAndServe(":"+viper.GetString("port"), authMiddleware(loggedRouter, logger)); err != nil {
+	if viper.IsSet("tls-cert-file") {
+		var reloader *certReloader
+		reloader, err = newCertReloader(viper.GetString("tls-cert-file"), viper.GetString("tls-key-file"), logger)
+		if err != nil {
+			log.Panicf("Unable to load TLS certificate: %s", err)
+		}
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		if mtls != nil {
+			// Client certificates are verified by the mTLS authenticator, as
+			// requests can also be authenticated by the other auth backends
+			srv.TLSConfig.ClientAuth = tls.RequestClientCert
+		}
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			logger.Info(fmt.Sprintf("Listening on port :%v (TLS)", viper.GetString("port")))
+			serveErr <- srv.ListenAndServeTLS("", "")
+		} else {
+			logger.Info(fmt.Sprintf("Listening on port :%v", viper.GetString("port")))
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
 		log.Panic(err)
-	} else {
-		logger.Info("Started server")
-		logger.Info(fmt.Sprintf("Listening on port :%v", viper.GetString("port")))
+	case <-ctx.Done():
+		// A second signal kills the process right away
+		stop()
 	}
+
+	// Stop accepting requests and let the in-flight requests and
+	// cron jobs finish, so no revocation is interrupted halfway
+	logger.Info("Shutting down, draining in-flight requests and cron jobs")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown-timeout"))
+	defer cancel()
+	c.Stop()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error(err, "Unable to drain the in-flight requests")
+		srv.Close()
+	}
+	if err := scheduled.wait(shutdownCtx); err != nil {
+		logger.Error(err, "Unable to wait for the running cron jobs")
+	}
+	if err := jm.Wait(shutdownCtx); err != nil {
+		logger.Error(err, "Unable to wait for the running background jobs")
+	}
+	// Hand over the leadership once the jobs are done
+	stopElection()
+	<-elected
+	vc.Close()
+	logger.Info("Server stopped")
 }
 
-func issueClientCertificateHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+func issueClientCertificateHandler(vc vault.AuthenticatedClient, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r, logger)
 		logger.WithValues("handler", "issueClientCertificateHandler")
 		client, err := vc.GetClient(logger)
 		if err != nil {
@@ -266,28 +736,112 @@ func issueClientCertificateHandler(vc vault.AuthenticatedClient, logger logr.Log
 			role = viper.GetString("vault-client-certificate-role")
 		}
 
-		cfg, err := operations.IssueClientCertificate(
+		if !allowedPKIRole(identityFromRequest(r), role) {
+			e := newAuditEntry(r, auditIssueCertificate)
+			e.Outcome = audit.OutcomeDenied
+			e.User, e.Device, e.Role = vars["user"], vars["device"], role
+			al.Record(r.Context(), e)
+			reportHttpError("forbidden", fmt.Errorf("not allowed to use PKI role '%s'", role),
+				http.StatusForbidden, w, logger)
+			return
+		}
+
+		var grace time.Duration
+		if param := r.URL.Query().Get("grace-period"); param != "" {
+			grace, err = time.ParseDuration(param)
+			if err != nil || grace < 0 {
+				reportHttpError("invalid grace-period "+param,
+					fmt.Errorf("grace-period must be a positive duration, like 24h"), http.StatusBadRequest, w, logger)
+				return
+			}
+			if grace > viper.GetDuration("max-grace-period") {
+				reportHttpError("invalid grace-period "+param,
+					fmt.Errorf("grace-period cannot be longer than %s", viper.GetDuration("max-grace-period")), http.StatusBadRequest, w, logger)
+				return
+			}
+		}
+
+		var accessUntil time.Time
+		if param := r.URL.Query().Get("access-until"); param != "" {
+			accessUntil, err = parseDate("access-until", param)
+			if err != nil {
+				reportHttpError("invalid access-until "+param,
+					err, http.StatusBadRequest, w, logger)
+				return
+			}
+		}
+
+		cfg, err := operations.IssueClientCertificate(r.Context(),
 			&operations.IssueCertificateRequest{
 				Client:              client,
 				VaultPKIPaths:       viper.GetStringSlice("vault-pki-paths"),
 				VaultKVConfigKey:    viper.GetString("vault-kv-config-key"),
 				VaultPKIRole:        role,
 				Username:            vars["user"],
+				Device:              vars["device"],
 				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
 				VaultKVPath:         viper.GetString("vault-kv-path"),
 				CfgTplPath:          viper.GetString("config-template-path"),
+				MaxRevocations:      viper.GetInt("crl-max-revocations"),
+				GracePeriod:         grace,
+				MaxDevices:          viper.GetInt("max-devices-per-user"),
+				AccessExpiresAt:     accessUntil,
 			}, logger.WithValues("operation", "issueCertificate"))
+		e := newAuditEntry(r, auditIssueCertificate)
+		e.User, e.Device, e.Role = vars["user"], vars["device"], role
+		auditErr := err
+		if cfg != nil {
+			e.Serials = append([]string{cfg.SerialNumber}, cfg.Revoked...)
+			if auditErr == nil && len(cfg.Skipped) > 0 {
+				auditErr = &operations.RevocationLimitError{Skipped: cfg.Skipped}
+			}
+		}
+		al.Record(r.Context(), auditResult(e, auditErr))
+		if err != nil && cfg != nil {
+			// The certificate was issued, but the previous
+			// certificates of the device are still valid
+			reportHttpError("certificate issued for user "+vars["user"]+", but the previous certificates were not revoked",
+				err, errorStatusCode(err), w, logger, "config", cfg.Config)
+			return
+		}
 		if err != nil {
 			reportHttpError("unable to issue client certificate for user "+vars["user"],
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success", "config": cfg.Config}))
+	}
+}
+
+func getClientConfigHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
 				err, http.StatusInternalServerError, w, logger)
 			return
 		}
-		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success", "config": cfg}))
+		vars := mux.Vars(r)
+		cfg, err := operations.GetClientConfig(r.Context(),
+			&operations.GetClientConfigRequest{
+				Client:           client,
+				VaultKVPath:      viper.GetString("vault-kv-path"),
+				VaultKVConfigKey: viper.GetString("vault-kv-config-key"),
+				Username:         vars["user"],
+				Device:           vars["device"],
+			}, logger.WithValues("operation", "getClientConfig"))
+		if err != nil {
+			reportHttpError("unable to retrieve the config of user "+vars["user"],
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+		fmt.Fprintln(w, jsonOutput(map[string]string{"config": cfg}))
 	}
 }
 
-func revokeUserHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+func revokeUserHandler(vc vault.AuthenticatedClient, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r, logger)
 		client, err := vc.GetClient(logger)
 		if err != nil {
 			reportHttpError("unable to get vault client",
@@ -295,19 +849,80 @@ func revokeUserHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.Ha
 			return
 		}
 		vars := mux.Vars(r)
-		err = operations.RevokeUser(
+		rsp, err := operations.RevokeUser(r.Context(),
 			&operations.RevokeUserRequest{
 				Client:              client,
 				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
 				Username:            vars["user"],
 				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				MaxRevocations:      viper.GetInt("crl-max-revocations"),
 			}, logger.WithValues("operation", "revokeUser"))
+		e := newAuditEntry(r, auditRevokeUser)
+		e.User = vars["user"]
+		if rsp != nil {
+			e.Serials = rsp.Revoked
+		}
+		al.Record(r.Context(), auditResult(e, err))
 		if err != nil {
 			reportHttpError("unable to revoke user "+vars["user"],
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+		b, err := json.MarshalIndent(map[string]any{
+			"result":                "success",
+			"terminatedConnections": rsp.TerminatedConnections,
+		}, "", "  ")
+		if err != nil {
+			reportHttpError("unable to parse revocation result",
 				err, http.StatusInternalServerError, w, logger)
 			return
 		}
-		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success"}))
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func revokeDeviceHandler(vc vault.AuthenticatedClient, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r, logger)
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		vars := mux.Vars(r)
+		rsp, err := operations.RevokeDevice(r.Context(),
+			&operations.RevokeDeviceRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				Username:            vars["user"],
+				Device:              vars["device"],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				MaxRevocations:      viper.GetInt("crl-max-revocations"),
+			}, logger.WithValues("operation", "revokeDevice"))
+		e := newAuditEntry(r, auditRevokeDevice)
+		e.User, e.Device = vars["user"], vars["device"]
+		if rsp != nil {
+			e.Serials = rsp.Revoked
+		}
+		al.Record(r.Context(), auditResult(e, err))
+		if err != nil {
+			reportHttpError("unable to revoke device "+vars["device"]+" of user "+vars["user"],
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+		b, err := json.MarshalIndent(map[string]any{
+			"result":                "success",
+			"terminatedConnections": rsp.TerminatedConnections,
+		}, "", "  ")
+		if err != nil {
+			reportHttpError("unable to parse revocation result",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
 	}
 }
 
@@ -319,7 +934,7 @@ func getCRLHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.Handle
 				err, http.StatusInternalServerError, w, logger)
 			return
 		}
-		crl, err := operations.GetCRL(
+		crl, err := operations.GetCRL(r.Context(),
 			&operations.GetCRLRequest{
 				Client:       client,
 				VaultPKIPath: viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
@@ -333,51 +948,260 @@ func getCRLHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.Handle
 	}
 }
 
-func updateCRLHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+func updateCRLHandler(vc vault.AuthenticatedClient, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r, logger)
 		client, err := vc.GetClient(logger)
 		if err != nil {
 			reportHttpError("unable to get vault client",
 				err, http.StatusInternalServerError, w, logger)
 			return
 		}
-		crl, err := operations.UpdateCRL(
+		crl, err := operations.UpdateCRL(r.Context(),
 			&operations.UpdateCRLRequest{
 				Client:              client,
 				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
 				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				MaxRevocations:      viper.GetInt("crl-max-revocations"),
+				Override:            r.URL.Query().Get("override") == "true",
 			}, logger.WithValues("operation", "updateCRL"))
+		if err == nil {
+			// The CRL was imported, but the older certificates
+			// have to be revoked with an override
+			err = crl.LimitError()
+		}
+		e := newAuditEntry(r, auditUpdateCRL)
+		if r.URL.Query().Get("override") == "true" {
+			e.Details = map[string]string{"override": "true"}
+		}
+		if crl != nil {
+			e.Serials = crl.Revoked
+		}
+		al.Record(r.Context(), auditResult(e, err))
 		if err != nil {
 			reportHttpError("unable to update CRL",
-				err, http.StatusInternalServerError, w, logger)
+				err, errorStatusCode(err), w, logger)
 			return
 		}
 
-		fmt.Fprintln(w, jsonOutput(map[string]string{"crl": string(crl)}))
+		fmt.Fprintln(w, jsonOutput(map[string]string{"crl": string(crl.CRL)}))
+	}
+}
+
+func previewUpdateCRLHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		crts, err := operations.PreviewUpdateCRL(r.Context(),
+			&operations.UpdateCRLRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			}, logger.WithValues("operation", "previewUpdateCRL"))
+		if err != nil {
+			reportHttpError("unable to preview CRL update",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		b, err := json.MarshalIndent(map[string]any{
+			"revocations":    crts,
+			"maxRevocations": viper.GetInt("crl-max-revocations"),
+		}, "", "  ")
+		if err != nil {
+			reportHttpError("unable to parse CRL update preview",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
 	}
 }
 
-func rotateCRLHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+func rotateCRLHandler(vc vault.AuthenticatedClient, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestLogger(r, logger)
 		client, err := vc.GetClient(logger)
 		if err != nil {
 			reportHttpError("unable to get vault client",
 				err, http.StatusInternalServerError, w, logger)
 			return
 		}
-		crl, err := operations.RotateCRL(
+		crl, err := operations.RotateCRL(r.Context(),
 			&operations.RotateCRLRequest{
 				Client:              client,
 				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
 				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+				MaxRevocations:      viper.GetInt("crl-max-revocations"),
+				Override:            r.URL.Query().Get("override") == "true",
 			}, logger.WithValues("operation", "rotateCRL"))
+		if err == nil {
+			// The CRL was imported, but the older certificates
+			// have to be revoked with an override
+			err = crl.LimitError()
+		}
+		e := newAuditEntry(r, auditRotateCRL)
+		if r.URL.Query().Get("override") == "true" {
+			e.Details = map[string]string{"override": "true"}
+		}
+		if crl != nil {
+			e.Serials = crl.Revoked
+		}
+		al.Record(r.Context(), auditResult(e, err))
 		if err != nil {
 			reportHttpError("unable to update CRL",
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+
+		fmt.Fprintln(w, jsonOutput(map[string]string{"crl": string(crl.CRL)}))
+	}
+}
+
+func getCRLStatusHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		status, err := operations.GetCRLStatus(r.Context(),
+			&operations.GetCRLStatusRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			}, logger.WithValues("operation", "getCRLStatus"))
+		if err != nil {
+			reportHttpError("unable to retrieve the CRL status",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		b, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			reportHttpError("unable to parse CRL status",
 				err, http.StatusInternalServerError, w, logger)
 			return
 		}
+		fmt.Fprintln(w, string(b))
+	}
+}
 
-		fmt.Fprintln(w, jsonOutput(map[string]string{"crl": string(crl)}))
+func listUserDevicesHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		vars := mux.Vars(r)
+		devices, err := operations.ListUserDevices(r.Context(),
+			&operations.ListUserDevicesRequest{
+				Client:       client,
+				VaultPKIPath: viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				Username:     vars["user"],
+			}, logger.WithValues("operation", "listUserDevices"))
+		if err != nil {
+			reportHttpError("unable to retrieve the devices of user "+vars["user"],
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		b, err := json.MarshalIndent(devices, "", "  ")
+		if err != nil {
+			reportHttpError("unable to parse device list",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func listAccessExpirationsHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		expirations, err := operations.ListAccessExpirations(r.Context(),
+			&operations.ListAccessExpirationsRequest{
+				Client:      client,
+				VaultKVPath: viper.GetString("vault-kv-path"),
+			}, logger.WithValues("operation", "listAccessExpirations"))
+		if err != nil {
+			reportHttpError("unable to retrieve the access expirations",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		b, err := json.MarshalIndent(expirations, "", "  ")
+		if err != nil {
+			reportHttpError("unable to parse access expirations",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
+func cancelAccessExpirationHandler(vc vault.AuthenticatedClient, al *audit.Logger, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		vars := mux.Vars(r)
+		err = operations.CancelAccessExpiration(r.Context(),
+			&operations.CancelAccessExpirationRequest{
+				Client:      client,
+				VaultKVPath: viper.GetString("vault-kv-path"),
+				Username:    vars["user"],
+			}, logger.WithValues("operation", "cancelAccessExpiration"))
+		e := newAuditEntry(r, auditCancelExpiration)
+		e.User = vars["user"]
+		al.Record(r.Context(), auditResult(e, err))
+		if err != nil {
+			reportHttpError("unable to cancel the access expiration of user "+vars["user"],
+				err, errorStatusCode(err), w, logger)
+			return
+		}
+		fmt.Fprintln(w, jsonOutput(map[string]string{"result": "success"}))
+	}
+}
+
+func listPendingRevocationsHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		revocations, err := operations.ListPendingRevocations(r.Context(),
+			&operations.ListPendingRevocationsRequest{
+				Client:      client,
+				VaultKVPath: viper.GetString("vault-kv-path"),
+			}, logger.WithValues("operation", "listPendingRevocations"))
+		if err != nil {
+			reportHttpError("unable to retrieve the pending revocations",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		b, err := json.MarshalIndent(revocations, "", "  ")
+		if err != nil {
+			reportHttpError("unable to parse pending revocations",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
 	}
 }
 
@@ -389,7 +1213,7 @@ func listUsersHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.Han
 				err, http.StatusInternalServerError, w, logger)
 			return
 		}
-		users, err := operations.ListUsers(
+		users, err := operations.ListUsers(r.Context(),
 			&operations.ListUsersRequest{
 				Client:       client,
 				VaultPKIPath: viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
@@ -409,6 +1233,36 @@ func listUsersHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.Han
 	}
 }
 
+func listUserActivityHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := vc.GetClient(logger)
+		if err != nil {
+			reportHttpError("unable to get vault client",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		activity, err := operations.ListUserActivity(r.Context(),
+			&operations.ListUserActivityRequest{
+				Client:              client,
+				VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultKVPath:         viper.GetString("vault-kv-path"),
+				ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			}, logger.WithValues("operation", "listUserActivity"))
+		if err != nil {
+			reportHttpError("unable to retrieve the user activity",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		b, err := json.MarshalIndent(activity, "", "  ")
+		if err != nil {
+			reportHttpError("unable to parse user activity",
+				err, http.StatusInternalServerError, w, logger)
+			return
+		}
+		fmt.Fprintln(w, string(b))
+	}
+}
+
 func healthzHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		client, err := vc.GetClient(logger)
@@ -418,7 +1272,7 @@ func healthzHandler(vc vault.AuthenticatedClient, logger logr.Logger) http.Handl
 			return
 		}
 		// Try to do a ListUsers to check health
-		_, err = operations.ListUsers(
+		_, err = operations.ListUsers(r.Context(),
 			&operations.ListUsersRequest{
 				Client:       client,
 				VaultPKIPath: viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
@@ -439,189 +1293,65 @@ func readyzHandler() http.HandlerFunc {
 	}
 }
 
-func authMiddleware(next http.Handler, logger logr.Logger) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var err error
-		var token string
-
-		// Check if this is a z endpoint (ie /healthz) in which case
-		// auth should be not enforced
-		zEndpoint, _ := regexp.MatchString("(.*)z$", r.URL.Path)
-
-		// GitHub auth enabled
-		if !zEndpoint && viper.IsSet("auth-github-org") {
-
-			gh := githubAuthOpts{
-				Organization: viper.GetString("auth-github-org"),
-			}
-
-			if r.Header.Get("Authorization") != "" {
-
-				// Header should be: "Authorization: Bearer <token>"
-				h := strings.Split(r.Header.Get("Authorization"), " ")
-				if len(h) == 2 && h[0] == "Bearer" {
-					token = h[1]
-				} else {
-					reportHttpError("unauthenticated", err, http.StatusUnauthorized, w, logger)
-					return
-				}
-			}
-
-			gh.Token = token
-			if viper.IsSet("auth-github-users") {
-				gh.AllowedUsers = viper.GetStringSlice("auth-github-users")
-			} else {
-				gh.AllowedUsers = []string{}
-			}
-			if viper.IsSet("auth-github-teams") {
-				gh.AllowedTeams = viper.GetStringSlice("auth-github-teams")
-			} else {
-				gh.AllowedTeams = []string{}
-			}
-
-			err = githubAuth(&gh)
-
-			if err != nil {
-				reportHttpError("unauthenticated", err, http.StatusUnauthorized, w, logger)
-				return
-			}
-		}
-		// Hanle request to the next handler in the chain
-		next.ServeHTTP(w, r)
-	}
-}
-
-// githubAuthOpts configured this auth backend
-type githubAuthOpts struct {
-	Token        string
-	Organization string
-	AllowedUsers []string
-	AllowedTeams []string
-}
-
-// githubAuth validates if the provided Github personal token
-// has access to the server by talking to the Github API.
-func githubAuth(gh *githubAuthOpts) error {
-
-	allowedUser := false
-	allowedTeam := false
-
-	ctx := context.Background() // TODO: change by context.WithTimeout()
-	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: gh.Token},
-	)
-	tc := oauth2.NewClient(ctx, ts)
-
-	client := github.NewClient(tc)
-
-	// Get the user
-	user, _, err := client.Users.Get(ctx, "")
+func jsonOutput(rsp map[string]string) string {
+	b, err := json.MarshalIndent(rsp, "", "  ")
 	if err != nil {
-		return err
-	}
-
-	// Verify that the user is part of the organization
-	var org *github.Organization
-	orgOpt := &github.ListOptions{
-		PerPage: 100,
-	}
-
-	var allOrgs []*github.Organization
-	for {
-		orgs, resp, err := client.Organizations.List(ctx, "", orgOpt)
-		if err != nil {
-			return err
-		}
-		allOrgs = append(allOrgs, orgs...)
-		if resp.NextPage == 0 {
-			break
-		}
-		orgOpt.Page = resp.NextPage
+		log.Panic("Error marhsalling the response json")
 	}
+	return string(b)
+}
 
-	for _, o := range allOrgs {
-		if strings.EqualFold(*o.Login, gh.Organization) {
-			org = o
-			break
-		}
-	}
-	if org == nil {
-		return errors.New("user is not part of required org")
+// parseDate parses the value of a date parameter. Both RFC3339
+// timestamps and dates (YYYY-MM-DD, midnight UTC) are accepted.
+func parseDate(param string, value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
 	}
-
-	if len(gh.AllowedTeams) != 0 {
-		// Get the teams that this user is part of to determine the policies
-		var teamNames []string
-		teamOpt := &github.ListOptions{
-			PerPage: 100,
-		}
-		var allTeams []*github.Team
-		for {
-			teams, resp, err := client.Teams.ListUserTeams(ctx, teamOpt)
-			if err != nil {
-				return err
-			}
-			allTeams = append(allTeams, teams...)
-			if resp.NextPage == 0 {
-				break
-			}
-			teamOpt.Page = resp.NextPage
-		}
-
-		for _, t := range allTeams {
-			// We only care about teams that are part of the organization we use
-			if *t.Organization.ID != *org.ID {
-				continue
-			}
-
-			// Append the names so we can get the policies
-			teamNames = append(teamNames, *t.Name)
-			if *t.Name != *t.Slug {
-				teamNames = append(teamNames, *t.Slug)
-			}
-		}
-
-		for _, t := range teamNames {
-			for _, at := range gh.AllowedTeams {
-				if strings.EqualFold(t, at) {
-					allowedTeam = true
-					break
-				}
-			}
-			if allowedTeam {
-				break
-			}
-		}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC3339 timestamp or a YYYY-MM-DD date", param)
 	}
+	return t, nil
+}
 
-	if len(gh.AllowedUsers) != 0 {
-		for _, u := range gh.AllowedUsers {
-			if strings.EqualFold(*user.Login, u) {
-				allowedUser = true
-				break
-			}
+// requestTimeout sets the deadline of the requests. Operations that
+// exceed it are cancelled, like when the client goes away.
+func requestTimeout(next http.Handler, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
 		}
+		next.ServeHTTP(w, r)
 	}
-
-	// If neither AllowedTeams not AllowedUsers is set, any user
-	// that belongs to the organization is allowed
-	if len(gh.AllowedTeams) == 0 && len(gh.AllowedUsers) == 0 {
-		return nil
-	} else if len(gh.AllowedUsers) > 0 && allowedUser {
-		return nil
-	} else if len(gh.AllowedTeams) > 0 && allowedTeam {
-		return nil
-	}
-
-	return errors.New("the user does not match any of the allowed users/teams")
 }
 
-func jsonOutput(rsp map[string]string) string {
-	b, err := json.MarshalIndent(rsp, "", "  ")
-	if err != nil {
-		log.Panic("Error marhsalling the response json")
+// errorStatusCode returns the http status code
+// that corresponds to an error from an operation
+func errorStatusCode(err error) int {
+	switch {
+	case errors.Is(err, operations.ErrRevocationLimitExceeded),
+		errors.Is(err, operations.ErrDeviceQuotaExceeded):
+		return http.StatusConflict
+	case errors.Is(err, operations.ErrInvalidUsername),
+		errors.Is(err, operations.ErrInvalidDeviceName),
+		errors.Is(err, operations.ErrInvalidAccessExpiration),
+		errors.Is(err, operations.ErrInvalidAPIKeyRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, operations.ErrAccessExpirationNotFound),
+		errors.Is(err, operations.ErrConfigNotFound),
+		errors.Is(err, operations.ErrAPIKeyNotFound),
+		errors.Is(err, jobs.ErrJobNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, audit.ErrNoReader):
+		return http.StatusNotImplemented
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
 	}
-	return string(b)
+	return http.StatusInternalServerError
 }
 
 func reportHttpError(msg string, err error, statusCode int, w http.ResponseWriter, logger logr.Logger, keys ...string) {
@@ -635,7 +1365,7 @@ func reportHttpError(msg string, err error, statusCode int, w http.ResponseWrite
 	}
 
 	for i, k := range keys {
-		if i%2 != 0 {
+		if i%2 == 0 {
 			rsp[k] = keys[i+1]
 		}
 	}
@@ -0,0 +1,176 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/go-logr/logr"
+	"github.com/spf13/viper"
+)
+
+const (
+	// certReloadInterval is how often the server certificate
+	// files are checked for changes
+	certReloadInterval = 10 * time.Second
+	// mtlsTrustRefreshInterval is how often the CA and the CRL used
+	// to authenticate client certificates are refreshed from Vault
+	mtlsTrustRefreshInterval = 5 * time.Minute
+)
+
+// certReloader serves the server certificate, reloading it from disk when
+// the certificate or key files change, so renewed certificates are used
+// without restarting the server
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   logr.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, logger logr.Logger) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// lastModified returns the latest modification time of both files
+func (c *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If the new
+// files can't be loaded, the previous certificate keeps being served.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < certReloadInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+
+	modTime, err := c.lastModified()
+	if err != nil {
+		c.logger.Error(err, "unable to check the TLS certificate files")
+		return c.cert, nil
+	}
+	if !modTime.Equal(c.modTime) {
+		if err := c.reload(); err != nil {
+			c.logger.Error(err, "unable to reload the TLS certificate")
+		} else {
+			c.logger.Info("TLS certificate reloaded")
+		}
+	}
+	return c.cert, nil
+}
+
+// mtlsAuthenticator authenticates callers by client certificates issued
+// from a Vault PKI role. The common name of the certificate is used as
+// the identity of the caller.
+type mtlsAuthenticator struct {
+	vc     vault.AuthenticatedClient
+	logger logr.Logger
+
+	mu    sync.Mutex
+	trust *operations.ClientAuthTrust
+}
+
+// newMTLSAuthenticator returns the client certificate authenticator.
+// It returns nil if client certificate auth is disabled.
+func newMTLSAuthenticator(vc vault.AuthenticatedClient, logger logr.Logger) (*mtlsAuthenticator, error) {
+	if !viper.IsSet("auth-mtls-pki-role") {
+		return nil, nil
+	}
+	if !viper.IsSet("tls-cert-file") {
+		return nil, errors.New("auth-mtls-pki-role requires tls-cert-file and tls-key-file")
+	}
+	a := &mtlsAuthenticator{vc: vc, logger: logger}
+	// Fail early if the role can't be used
+	if _, err := a.getTrust(context.Background()); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// getTrust returns the trust data of the PKI role, refreshing it when
+// it gets old. If the refresh fails, the previous data is used.
+func (a *mtlsAuthenticator) getTrust(ctx context.Context) (*operations.ClientAuthTrust, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.trust != nil && time.Since(a.trust.FetchedAt) < mtlsTrustRefreshInterval {
+		return a.trust, nil
+	}
+
+	client, err := a.vc.GetClient(a.logger)
+	if err == nil {
+		var trust *operations.ClientAuthTrust
+		trust, err = operations.GetClientAuthTrust(ctx,
+			&operations.GetClientAuthTrustRequest{
+				Client:       client,
+				VaultPKIPath: viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+				VaultPKIRole: viper.GetString("auth-mtls-pki-role"),
+			}, a.logger.WithValues("operation", "getClientAuthTrust"))
+		if err == nil {
+			a.trust = trust
+			return a.trust, nil
+		}
+	}
+	if a.trust == nil {
+		return nil, err
+	}
+	a.logger.Error(err, "unable to refresh client certificate trust data, using the previous one")
+	return a.trust, nil
+}
+
+// Authenticate verifies the client certificate chain presented by the caller
+func (a *mtlsAuthenticator) Authenticate(ctx context.Context, chain []*x509.Certificate) (*identity, error) {
+	trust, err := a.getTrust(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := trust.Verify(chain); err != nil {
+		return nil, err
+	}
+	if chain[0].Subject.CommonName == "" {
+		return nil, errors.New("client certificate has no common name")
+	}
+	return &identity{Login: chain[0].Subject.CommonName}, nil
+}
@@ -0,0 +1,171 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/audit"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/ha"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/notify"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/operations"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+	"github.com/spf13/viper"
+)
+
+const (
+	// crlRotationInitialBackoff is the delay before the first
+	// retry of a failed CRL rotation. It doubles on each retry.
+	crlRotationInitialBackoff time.Duration = 30 * time.Second
+	// crlRotationMaxBackoff caps the delay between retries
+	crlRotationMaxBackoff time.Duration = 5 * time.Minute
+)
+
+// crlWatchdog periodically checks the remaining lifetime of the CRLs in Vault and
+// in the Client VPN endpoint. The CRL is rotated if it is close to expiry, and an
+// alert is sent if the remaining lifetime drops below the alert threshold.
+type crlWatchdog struct {
+	vc       vault.AuthenticatedClient
+	notifier notify.Notifier
+	audit    *audit.Logger
+	// mutations serializes the rotations with
+	// other replicas. Nil if HA mode is disabled.
+	mutations *ha.Lock
+}
+
+func newCRLWatchdog(vc vault.AuthenticatedClient, al *audit.Logger, mutations *ha.Lock, logger logr.Logger) *crlWatchdog {
+	notifiers := notify.MultiNotifier{&notify.LogNotifier{Logger: logger}}
+	if viper.IsSet("notify-webhook-url") {
+		notifiers = append(notifiers, &notify.WebhookNotifier{
+			URL:    viper.GetString("notify-webhook-url"),
+			Client: &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+	return &crlWatchdog{
+		vc:        vc,
+		notifier:  notifiers,
+		audit:     al,
+		mutations: mutations,
+	}
+}
+
+// run performs a single check of the CRLs. It returns an
+// error if the CRL can't be checked or rotated.
+func (wd *crlWatchdog) run(ctx context.Context, logger logr.Logger) error {
+	logger = logger.WithValues("operation", "crlWatchdog")
+	client, err := wd.vc.GetClient(logger)
+	if err != nil {
+		logger.Error(err, "Failed while creating Vault client")
+		return err
+	}
+
+	status, err := wd.status(ctx, client, logger)
+	if err != nil {
+		wd.alert(ctx, "Unable to check the CRL status", map[string]string{"error": err.Error()}, logger)
+		return err
+	}
+
+	var rotationErr error
+	if time.Until(status.NextUpdate()) < viper.GetDuration("crl-rotation-threshold") {
+		logger.Info("CRL close to expiry, rotating", "nextUpdate", status.NextUpdate())
+		if rotationErr = wd.rotate(ctx, client, logger); rotationErr != nil {
+			wd.alert(ctx, "Unable to rotate the CRL", map[string]string{
+				"error":      rotationErr.Error(),
+				"nextUpdate": status.NextUpdate().String(),
+			}, logger)
+		} else if status, err = wd.status(ctx, client, logger); err != nil {
+			wd.alert(ctx, "Unable to check the CRL status", map[string]string{"error": err.Error()}, logger)
+			return err
+		}
+	}
+
+	if remaining := time.Until(status.NextUpdate()); remaining < viper.GetDuration("crl-alert-threshold") {
+		wd.alert(ctx, "The CRL is about to expire, AWS Client VPN will reject all connections once it does",
+			map[string]string{
+				"nextUpdate": status.NextUpdate().String(),
+				"remaining":  remaining.Round(time.Second).String(),
+			}, logger)
+	}
+	return rotationErr
+}
+
+func (wd *crlWatchdog) status(ctx context.Context, client *api.Client, logger logr.Logger) (*operations.CRLStatus, error) {
+	return operations.GetCRLStatus(ctx,
+		&operations.GetCRLStatusRequest{
+			Client:              client,
+			VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+		}, logger)
+}
+
+// rotate tries to rotate the CRL, retrying with an exponential
+// backoff until it succeeds or the retries are exhausted
+func (wd *crlWatchdog) rotate(ctx context.Context, client *api.Client, logger logr.Logger) error {
+	var err error
+	backoff := crlRotationInitialBackoff
+	for attempt := 0; attempt <= viper.GetInt("crl-rotation-retries"); attempt++ {
+		if attempt > 0 {
+			logger.Info(fmt.Sprintf("Retrying CRL rotation in %s", backoff), "attempt", attempt)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff = min(2*backoff, crlRotationMaxBackoff)
+		}
+		err = wd.rotateOnce(ctx, client, logger)
+		if err == nil {
+			logger.Info("Vault CRL rotated by CRL watchdog")
+			return nil
+		}
+		logger.Error(err, "CRL watchdog failed trying to rotate the CRL", "attempt", attempt)
+		// The CRL was rotated, retrying would skip the same certificates
+		if errors.Is(err, operations.ErrRevocationLimitExceeded) {
+			return err
+		}
+	}
+	return err
+}
+
+// rotateOnce rotates the CRL holding the mutations lock. The lock is not
+// held between retries, so the API can be used while the watchdog waits.
+func (wd *crlWatchdog) rotateOnce(ctx context.Context, client *api.Client, logger logr.Logger) error {
+	unlock, err := lockMutations(ctx, wd.mutations)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	rsp, err := operations.RotateCRL(ctx,
+		&operations.RotateCRLRequest{
+			Client:              client,
+			VaultPKIPath:        viper.GetStringSlice("vault-pki-paths")[len(viper.GetStringSlice("vault-pki-paths"))-1],
+			VaultKVPath:         viper.GetString("vault-kv-path"),
+			ClientVPNEndpointID: viper.GetString("client-vpn-endpoint-id"),
+			MaxRevocations:      viper.GetInt("crl-max-revocations"),
+		}, logger)
+	if err == nil {
+		err = rsp.LimitError()
+	}
+	e := newSystemAuditEntry(auditRotateCRL, "watchdog")
+	if rsp != nil {
+		e.Serials = rsp.Revoked
+	}
+	wd.audit.Record(ctx, auditResult(e, err))
+	return err
+}
+
+func (wd *crlWatchdog) alert(ctx context.Context, summary string, details map[string]string, logger logr.Logger) {
+	err := wd.notifier.Notify(ctx, &notify.Alert{
+		Summary: summary,
+		Details: details,
+		Time:    time.Now(),
+	})
+	if err != nil {
+		logger.Error(err, "unable to send alert")
+	}
+}
@@ -0,0 +1,267 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Outcomes of the audited actions
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// ErrNoReader is returned when querying the audit log
+// and none of the sinks can be read back
+var ErrNoReader = errors.New("no readable audit sink configured")
+
+// Entry is a record of the audit log. Each entry is chained to
+// the previous one by including its hash, so removing or modifying
+// an entry breaks the chain from that point on.
+type Entry struct {
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	User     string    `json:"user,omitempty"`
+	Device   string    `json:"device,omitempty"`
+	Serials  []string  `json:"serials,omitempty"`
+	Role     string    `json:"role,omitempty"`
+	SourceIP string    `json:"sourceIP,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+	// Details holds any other data relevant to the action
+	Details  map[string]string `json:"details,omitempty"`
+	PrevHash string            `json:"prevHash"`
+	Hash     string            `json:"hash"`
+}
+
+// computeHash returns the hex encoded sha256 hash of
+// the entry, computed with an empty Hash field
+func (e *Entry) computeHash() (string, error) {
+	c := *e
+	c.Hash = ""
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Sink stores the entries of the audit log
+type Sink interface {
+	Write(ctx context.Context, e *Entry) error
+}
+
+// Reader is implemented by the sinks that can read
+// back the entries they store, oldest first
+type Reader interface {
+	Read(ctx context.Context) ([]Entry, error)
+}
+
+// SealFunc completes the entry with its sequence and hashes,
+// chaining it to prev, the last entry stored. prev is nil
+// if no entry has been stored yet.
+type SealFunc func(e *Entry, prev *Entry) error
+
+// Appender is implemented by the sinks that can hold the hash chain.
+// Append reads the last entry stored, seals the entry with it and
+// stores the entry, so the chain continues from the stored entries
+// even if other replicas write to the same store.
+type Appender interface {
+	Append(ctx context.Context, e *Entry, seal SealFunc) error
+}
+
+// seal chains the entry to prev
+func seal(e *Entry, prev *Entry) error {
+	e.Sequence, e.PrevHash, e.Hash = 1, "", ""
+	if prev != nil {
+		e.Sequence, e.PrevHash = prev.Sequence+1, prev.Hash
+	}
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	return nil
+}
+
+// Logger records audit entries in the configured sinks. Entries are
+// also always written to the application log.
+type Logger struct {
+	sinks  []Sink
+	logger logr.Logger
+
+	mu sync.Mutex
+	// head is the last entry recorded by this logger. The chain is
+	// continued from the chain sink, head is only used without one,
+	// or if the chain sink can't be written.
+	head *Entry
+}
+
+// NewLogger returns an audit logger that writes to the given sinks
+func NewLogger(logger logr.Logger, sinks ...Sink) *Logger {
+	return &Logger{sinks: sinks, logger: logger.WithName("audit")}
+}
+
+// reader returns the first sink that can be read back
+func (l *Logger) reader() Reader {
+	for _, s := range l.sinks {
+		if r, ok := s.(Reader); ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// chain returns the sink that holds the hash chain and its index: the
+// sink read back, if it can be appended to. It returns nil otherwise.
+func (l *Logger) chain() (int, Appender) {
+	for i, s := range l.sinks {
+		if _, ok := s.(Reader); !ok {
+			continue
+		}
+		if a, ok := s.(Appender); ok {
+			return i, a
+		}
+		break
+	}
+	return -1, nil
+}
+
+// Record completes the entry with its sequence, time and hashes and writes
+// it to all the sinks. The entry is chained to the last one stored in the
+// chain sink. Failures to write to a sink are logged but don't stop the
+// audited action. The entry is written even if ctx is cancelled, as the
+// action may have been partially done.
+func (l *Logger) Record(ctx context.Context, e *Entry) {
+	ctx = context.WithoutCancel(ctx)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Time = time.Now().UTC()
+	stored := false
+	ci, chain := l.chain()
+	if chain != nil {
+		if err := chain.Append(ctx, e, seal); err != nil {
+			l.logger.Error(err, fmt.Sprintf("unable to write audit entry to sink %T, the hash chain will be broken", chain))
+		} else {
+			stored = true
+		}
+	}
+	if !stored {
+		if err := seal(e, l.head); err != nil {
+			l.logger.Error(err, "unable to hash audit entry")
+			return
+		}
+	}
+
+	l.logger.Info(e.Action, "sequence", e.Sequence, "actor", e.Actor, "user", e.User, "device", e.Device,
+		"serials", e.Serials, "role", e.Role, "sourceIP", e.SourceIP, "outcome", e.Outcome,
+		"error", e.Error, "details", e.Details, "hash", e.Hash)
+
+	for i, s := range l.sinks {
+		if i == ci {
+			continue
+		}
+		if err := s.Write(ctx, e); err != nil {
+			l.logger.Error(err, fmt.Sprintf("unable to write audit entry %d to sink %T", e.Sequence, s))
+			continue
+		}
+		stored = true
+	}
+
+	// The next entry is only chained to this one if it was stored
+	if stored || len(l.sinks) == 0 {
+		head := *e
+		l.head = &head
+	}
+}
+
+// Query are the filters to select entries of the audit log.
+// Empty fields match any entry.
+type Query struct {
+	Actor  string
+	Action string
+	User   string
+	Since  time.Time
+	Until  time.Time
+	// Limit returns only the latest matching entries
+	Limit int
+}
+
+func (q *Query) matches(e *Entry) bool {
+	return (q.Actor == "" || q.Actor == e.Actor) &&
+		(q.Action == "" || q.Action == e.Action) &&
+		(q.User == "" || q.User == e.User) &&
+		(q.Since.IsZero() || !e.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || e.Time.Before(q.Until))
+}
+
+// Query returns the entries that match the query, oldest first
+func (l *Logger) Query(ctx context.Context, q *Query) ([]Entry, error) {
+	r := l.reader()
+	if r == nil {
+		return nil, ErrNoReader
+	}
+	entries, err := r.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	matched := []Entry{}
+	for i := range entries {
+		if q.matches(&entries[i]) {
+			matched = append(matched, entries[i])
+		}
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[len(matched)-q.Limit:]
+	}
+	return matched, nil
+}
+
+// Verify reads the whole audit log and checks its hash chain.
+// It returns the number of entries verified.
+func (l *Logger) Verify(ctx context.Context) (int, error) {
+	r := l.reader()
+	if r == nil {
+		return 0, ErrNoReader
+	}
+	entries, err := r.Read(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), Verify(entries)
+}
+
+// Verify checks that each entry has not been modified and
+// is chained to the previous one
+func Verify(entries []Entry) error {
+	for i := range entries {
+		e := &entries[i]
+		hash, err := e.computeHash()
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			return fmt.Errorf("audit entry %d has been modified", e.Sequence)
+		}
+		if i > 0 {
+			prev := &entries[i-1]
+			if e.PrevHash != prev.Hash || e.Sequence != prev.Sequence+1 {
+				return fmt.Errorf("audit chain broken between entries %d and %d", prev.Sequence, e.Sequence)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+// chain returns n entries chained to each other
+func chain(t *testing.T, n int) []Entry {
+	t.Helper()
+	entries := []Entry{}
+	var prev *Entry
+	for i := 0; i < n; i++ {
+		e := Entry{Actor: "alice", Action: "user.revoke", User: "bob", Outcome: OutcomeSuccess}
+		if err := seal(&e, prev); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+		prev = &entries[len(entries)-1]
+	}
+	return entries
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func([]Entry) []Entry
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			tamper: func(e []Entry) []Entry { return e },
+		},
+		{
+			name:   "empty",
+			tamper: func(e []Entry) []Entry { return nil },
+		},
+		{
+			name: "modified entry",
+			tamper: func(e []Entry) []Entry {
+				e[1].User = "carol"
+				return e
+			},
+			wantErr: "audit entry 2 has been modified",
+		},
+		{
+			name: "removed entry",
+			tamper: func(e []Entry) []Entry {
+				return append(e[:1], e[2:]...)
+			},
+			wantErr: "audit chain broken between entries 1 and 3",
+		},
+		{
+			name: "reordered entries",
+			tamper: func(e []Entry) []Entry {
+				e[1], e[2] = e[2], e[1]
+				return e
+			},
+			wantErr: "audit chain broken",
+		},
+		{
+			name: "rehashed entry",
+			tamper: func(e []Entry) []Entry {
+				e[1].User = "carol"
+				e[1].Hash, _ = e[1].computeHash()
+				return e
+			},
+			wantErr: "audit chain broken between entries 2 and 3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.tamper(chain(t, 4)))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Verify() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Verify() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoggerContinuesTheStoredChain(t *testing.T) {
+	ctx := context.Background()
+	sink := &FileSink{Path: filepath.Join(t.TempDir(), "audit.log")}
+
+	NewLogger(logr.Discard(), sink).Record(ctx, &Entry{Actor: "alice", Action: "user.revoke"})
+	// Another logger, like after a restart, continues the chain in the file
+	l := NewLogger(logr.Discard(), sink)
+	l.Record(ctx, &Entry{Actor: "alice", Action: "user.revoke"})
+	l.Record(ctx, &Entry{Actor: "alice", Action: "crl.update"})
+
+	n, err := l.Verify(ctx)
+	if err != nil {
+		t.Fatalf("Verify() = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Verify() checked %d entries, want 3", n)
+	}
+}
+
+func TestLoggerOnlyAdvancesOnStoredEntries(t *testing.T) {
+	ctx := context.Background()
+	fail := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	l := NewLogger(logr.Discard(), &WebhookSink{URL: srv.URL})
+
+	lost := &Entry{Actor: "alice", Action: "user.revoke"}
+	l.Record(ctx, lost)
+	fail = false
+	stored := &Entry{Actor: "alice", Action: "user.revoke"}
+	l.Record(ctx, stored)
+	next := &Entry{Actor: "alice", Action: "user.revoke"}
+	l.Record(ctx, next)
+
+	if stored.Sequence != 1 || stored.PrevHash != "" {
+		t.Errorf("entry chained to an entry that was not stored: sequence %d, prevHash %q", stored.Sequence, stored.PrevHash)
+	}
+	if err := Verify([]Entry{*stored, *next}); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+}
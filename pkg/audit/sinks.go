@@ -0,0 +1,340 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// FileSink appends the entries as JSON lines to a file
+type FileSink struct {
+	Path string
+}
+
+// Write appends the entry to the file
+func (fs *FileSink) Write(ctx context.Context, e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// fileSinkTail is how much of the end of the file is read to
+// find the last entry, as long as the longest entry it can read
+const fileSinkTail = 1024 * 1024
+
+// Append chains the entry to the last one in the file and appends it
+func (fs *FileSink) Append(ctx context.Context, e *Entry, seal SealFunc) error {
+	prev, err := fs.last()
+	if err != nil {
+		return err
+	}
+	if err := seal(e, prev); err != nil {
+		return err
+	}
+	return fs.Write(ctx, e)
+}
+
+// last returns the last entry in the file, nil if there is none
+func (fs *FileSink) last() (*Entry, error) {
+	f, err := os.Open(fs.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := max(info.Size()-fileSinkTail, 0)
+	tail := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(tail, offset); err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(bytes.TrimSpace(tail), []byte("\n"))
+	line := lines[len(lines)-1]
+	if len(line) == 0 {
+		return nil, nil
+	}
+	e := &Entry{}
+	if err := json.Unmarshal(line, e); err != nil {
+		return nil, fmt.Errorf("unable to parse the last audit entry: %w", err)
+	}
+	return e, nil
+}
+
+// Read returns all the entries in the file
+func (fs *FileSink) Read(ctx context.Context) ([]Entry, error) {
+	f, err := os.Open(fs.Path)
+	if os.IsNotExist(err) {
+		return []Entry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []Entry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		e := Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("unable to parse audit entry after sequence %d: %w", len(entries), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// VaultSink stores the entries in the kv (v2) store, in one secret per
+// day under the "acpm/audit/" prefix. Secrets are written with
+// check-and-set, so replicas sharing the store never overwrite each
+// other's entries nor fork the hash chain.
+type VaultSink struct {
+	Client vault.AuthenticatedClient
+	KVPath string
+	Logger logr.Logger
+}
+
+const (
+	vaultSinkPrefix = "acpm/audit"
+	// vaultSinkRetries is how many times an entry is retried
+	// when it conflicts with the entry of another replica
+	vaultSinkRetries = 10
+	dayLayout        = "2006-01-02"
+)
+
+type vaultSinkDay struct {
+	Entries []Entry `json:"entries"`
+	// Closed is set before the first entry of a later day is
+	// written, so no replica appends to this day anymore
+	Closed bool `json:"closed,omitempty"`
+}
+
+func (vs *VaultSink) path(day string) string {
+	return fmt.Sprintf("%s/data/%s/%s", vs.KVPath, vaultSinkPrefix, day)
+}
+
+// readDay returns the entries of the day and the version
+// of the secret, to write it back with check-and-set
+func (vs *VaultSink) readDay(ctx context.Context, client *api.Client, day string) (*vaultSinkDay, int, error) {
+	data := &vaultSinkDay{}
+	secret, err := client.Logical().ReadWithContext(ctx, vs.path(day))
+	if err != nil {
+		return nil, 0, err
+	}
+	if secret == nil {
+		return data, 0, nil
+	}
+	version := 0
+	if md, ok := secret.Data["metadata"].(map[string]any); ok {
+		if v, ok := md["version"].(json.Number); ok {
+			n, err := v.Int64()
+			if err != nil {
+				return nil, 0, err
+			}
+			version = int(n)
+		}
+	}
+	if secret.Data["data"] == nil {
+		return data, version, nil
+	}
+	b, err := json.Marshal(secret.Data["data"])
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := json.Unmarshal(b, data); err != nil {
+		return nil, 0, err
+	}
+	return data, version, nil
+}
+
+// writeDay stores the entries of the day if the secret is still at the
+// given version. It returns false if another replica wrote it first.
+func (vs *VaultSink) writeDay(ctx context.Context, client *api.Client, day string, data *vaultSinkDay, version int) (bool, error) {
+	_, err := client.Logical().WriteWithContext(ctx, vs.path(day), map[string]any{
+		"options": map[string]any{"cas": version},
+		"data":    data,
+	})
+	var rspErr *api.ResponseError
+	if errors.As(err, &rspErr) && rspErr.StatusCode == http.StatusBadRequest &&
+		strings.Contains(strings.Join(rspErr.Errors, " "), "check-and-set") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// days returns the days with entries, oldest first
+func (vs *VaultSink) days(ctx context.Context, client *api.Client) ([]string, error) {
+	secret, err := client.Logical().ListWithContext(ctx, fmt.Sprintf("%s/metadata/%s", vs.KVPath, vaultSinkPrefix))
+	if err != nil {
+		return nil, err
+	}
+	days := []string{}
+	if secret == nil || secret.Data["keys"] == nil {
+		return days, nil
+	}
+	for _, k := range secret.Data["keys"].([]any) {
+		days = append(days, k.(string))
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// Write adds the entry, already sealed, to the
+// secret of the last day, or of the day of the entry
+func (vs *VaultSink) Write(ctx context.Context, e *Entry) error {
+	return vs.Append(ctx, e, func(*Entry, *Entry) error { return nil })
+}
+
+// Append chains the entry to the last one stored and adds it to the secret
+// of the last day, or of the day of the entry if it is later. If another
+// replica adds an entry first, the entry is chained again to that one.
+func (vs *VaultSink) Append(ctx context.Context, e *Entry, seal SealFunc) error {
+	client, err := vs.Client.GetClient(vs.Logger)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		days, err := vs.days(ctx, client)
+		if err != nil {
+			return err
+		}
+		latest, data, version := "", &vaultSinkDay{}, 0
+		if len(days) > 0 {
+			latest = days[len(days)-1]
+			if data, version, err = vs.readDay(ctx, client, latest); err != nil {
+				return err
+			}
+		}
+
+		// Entries never go to an earlier day than the last one, even
+		// if the clock of this replica is behind the other ones
+		day := e.Time.Format(dayLayout)
+		if latest != "" && day <= latest {
+			day = latest
+			if data.Closed {
+				t, err := time.Parse(dayLayout, latest)
+				if err != nil {
+					return err
+				}
+				day = t.AddDate(0, 0, 1).Format(dayLayout)
+			}
+		}
+		var prev *Entry
+		if n := len(data.Entries); n > 0 {
+			prev = &data.Entries[n-1]
+		}
+		if err := seal(e, prev); err != nil {
+			return err
+		}
+
+		var ok bool
+		if day == latest {
+			data.Entries = append(data.Entries, *e)
+			ok, err = vs.writeDay(ctx, client, day, data, version)
+		} else {
+			// The last day is closed first, so an entry added to it
+			// by another replica in the meantime makes this one fail
+			if latest != "" && !data.Closed {
+				data.Closed = true
+				ok, err = vs.writeDay(ctx, client, latest, data, version)
+			} else {
+				ok = true
+			}
+			if err == nil && ok {
+				ok, err = vs.writeDay(ctx, client, day, &vaultSinkDay{Entries: []Entry{*e}}, 0)
+			}
+		}
+		if err != nil || ok {
+			return err
+		}
+		if attempt >= vaultSinkRetries {
+			return fmt.Errorf("unable to write audit entry: too many concurrent writes")
+		}
+	}
+}
+
+// Read returns all the entries stored in the kv store
+func (vs *VaultSink) Read(ctx context.Context) ([]Entry, error) {
+	client, err := vs.Client.GetClient(vs.Logger)
+	if err != nil {
+		return nil, err
+	}
+	days, err := vs.days(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	for _, day := range days {
+		data, _, err := vs.readDay(ctx, client, day)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, data.Entries...)
+	}
+	return entries, nil
+}
+
+// WebhookSink posts each entry as JSON to a webhook URL
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// Write sends the entry to the webhook
+func (ws *WebhookSink) Write(ctx context.Context, e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := ws.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status code %d", rsp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// fakeKV is a kv (v2) store mounted at "secret" that honors check-and-set
+type fakeKV struct {
+	mu       sync.Mutex
+	secrets  map[string]map[string]any
+	versions map[string]int
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if prefix, ok := strings.CutPrefix(r.URL.Path, "/v1/secret/metadata/"); ok {
+		keys := []string{}
+		for key := range kv.secrets {
+			if rest, ok := strings.CutPrefix(key, prefix+"/"); ok {
+				keys = append(keys, rest)
+			}
+		}
+		if len(keys) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"keys": keys}})
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/v1/secret/data/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := kv.secrets[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"data": map[string]any{
+				"data":     data,
+				"metadata": map[string]any{"version": kv.versions[key]},
+			},
+		})
+	case http.MethodPut, http.MethodPost:
+		body := struct {
+			Options map[string]any `json:"options"`
+			Data    map[string]any `json:"data"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if cas, ok := body.Options["cas"].(float64); ok && int(cas) != kv.versions[key] {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+			return
+		}
+		kv.secrets[key] = body.Data
+		kv.versions[key]++
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"version": kv.versions[key]}})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (kv *fakeKV) days() []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	days := []string{}
+	for key := range kv.secrets {
+		days = append(days, strings.TrimPrefix(key, vaultSinkPrefix+"/"))
+	}
+	sort.Strings(days)
+	return days
+}
+
+// testClient is an AuthenticatedClient for the fake kv store
+type testClient struct {
+	client *api.Client
+}
+
+func (tc *testClient) GetClient(logr.Logger) (*api.Client, error) { return tc.client, nil }
+func (tc *testClient) Close()                                     {}
+
+func newVaultSink(t *testing.T) (*VaultSink, *fakeKV) {
+	t.Helper()
+	kv := &fakeKV{secrets: map[string]map[string]any{}, versions: map[string]int{}}
+	srv := httptest.NewServer(kv)
+	t.Cleanup(srv.Close)
+
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	cfg.MaxRetries = 0
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &VaultSink{Client: &testClient{client: client}, KVPath: "secret", Logger: logr.Discard()}, kv
+}
+
+func TestVaultSinkReplicasShareTheChain(t *testing.T) {
+	sink, _ := newVaultSink(t)
+	ctx := context.Background()
+
+	// Each replica has its own logger writing to the same store
+	replicas := []*Logger{NewLogger(logr.Discard(), sink), NewLogger(logr.Discard(), sink)}
+	var wg sync.WaitGroup
+	for _, l := range replicas {
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.Record(ctx, &Entry{Actor: "alice", Action: "user.revoke"})
+			}()
+		}
+	}
+	wg.Wait()
+
+	n, err := replicas[0].Verify(ctx)
+	if err != nil {
+		t.Fatalf("Verify() = %v", err)
+	}
+	if n != 10 {
+		t.Errorf("Verify() checked %d entries, want 10", n)
+	}
+}
+
+func TestVaultSinkDayRollover(t *testing.T) {
+	sink, kv := newVaultSink(t)
+	ctx := context.Background()
+	day := time.Date(2024, 5, 2, 23, 59, 0, 0, time.UTC)
+
+	for _, ts := range []time.Time{
+		day,
+		day.Add(2 * time.Minute),
+		// A replica whose clock is behind doesn't write to a closed day
+		day.Add(-time.Minute),
+	} {
+		if err := sink.Append(ctx, &Entry{Time: ts, Action: "user.revoke"}, seal); err != nil {
+			t.Fatalf("Append() = %v", err)
+		}
+	}
+
+	if got, want := kv.days(), []string{"2024-05-02", "2024-05-03"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("entries stored in days %v, want %v", got, want)
+	}
+	first, _, err := sink.readDay(ctx, sink.Client.(*testClient).client, "2024-05-02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Closed || len(first.Entries) != 1 {
+		t.Errorf("first day closed=%t with %d entries, want closed with 1", first.Closed, len(first.Entries))
+	}
+
+	entries, err := sink.Read(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Read() returned %d entries, want 3", len(entries))
+	}
+	if err := Verify(entries); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+}
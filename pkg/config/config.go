@@ -2,7 +2,22 @@ package config
 
 import "time"
 
-const (
+// Timeouts of each call to Vault and AWS. The server
+// overrides them with the values of its flags.
+var (
 	VaultApiTimeout time.Duration = 30 * time.Second
 	AwsApiTimeout   time.Duration = 30 * time.Second
 )
+
+// CertIndexKVPath is the path of the kv (v2) store where the certificate
+// index is persisted, so it survives restarts. Empty keeps it in memory.
+var CertIndexKVPath string
+
+const (
+	// AuthApiTimeout is the timeout of the requests
+	// to the identity provider of the auth backend
+	AuthApiTimeout time.Duration = 30 * time.Second
+	// AwsMaxCRLEntries is the maximum number of entries
+	// that AWS Client VPN accepts in a CRL
+	AwsMaxCRLEntries int = 20000
+)
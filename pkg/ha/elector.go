@@ -0,0 +1,132 @@
+package ha
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/metrics"
+	"github.com/go-logr/logr"
+)
+
+// Elector elects the leader among the replicas by holding a lock. The
+// leader keeps renewing the lock, and the other replicas take it over
+// once it expires, if the leader dies or can't reach Vault.
+type Elector struct {
+	lock   *Lock
+	logger logr.Logger
+
+	mu sync.Mutex
+	// record is the last known state of the lock
+	record *LockRecord
+	// leaseEnd is when the leadership of this replica ends
+	// if it can't renew the lock, zero if it is not the leader
+	leaseEnd time.Time
+}
+
+// Status is the leadership state as seen by a replica
+type Status struct {
+	Replica   string     `json:"replica"`
+	Leader    bool       `json:"leader"`
+	Holder    string     `json:"holder,omitempty"`
+	Since     *time.Time `json:"since,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// NewElector returns the elector that competes for the lock
+func NewElector(lock *Lock, logger logr.Logger) *Elector {
+	return &Elector{lock: lock, logger: logger.WithValues("lock", lock.name)}
+}
+
+// Run takes part in the election until ctx is done. The
+// lock is released on exit if this replica is the leader.
+func (e *Elector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.lock.ttl / 3)
+	defer ticker.Stop()
+	for {
+		e.try(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			e.resign()
+			return
+		}
+	}
+}
+
+func (e *Elector) try(ctx context.Context) {
+	wasLeader := e.IsLeader()
+	attempt := time.Now()
+	record, ok, err := e.lock.TryAcquire(ctx)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		// Keep the leadership until the lock expires,
+		// as no other replica can take it before
+		e.logger.Error(err, "unable to update the leader lock")
+	} else {
+		e.record = record
+		if ok {
+			// The TTL counts from before the write, so this
+			// replica never considers itself the leader for
+			// longer than the lock lasts for the others
+			e.leaseEnd = attempt.Add(e.lock.ttl)
+		} else {
+			e.leaseEnd = time.Time{}
+		}
+	}
+
+	isLeader := time.Now().Before(e.leaseEnd)
+	if isLeader != wasLeader {
+		if isLeader {
+			e.logger.Info("This replica is now the leader")
+		} else {
+			e.logger.Info("This replica is no longer the leader")
+		}
+	}
+	if isLeader {
+		metrics.Leader.Set(1)
+	} else {
+		metrics.Leader.Set(0)
+	}
+}
+
+// resign releases the lock, so another replica can take over right away
+func (e *Elector) resign() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !time.Now().Before(e.leaseEnd) {
+		return
+	}
+	e.leaseEnd = time.Time{}
+	metrics.Leader.Set(0)
+	if err := e.lock.Release(context.Background()); err != nil {
+		e.logger.Error(err, "unable to release the leader lock, it will be free once it expires")
+		return
+	}
+	e.logger.Info("Leadership released")
+}
+
+// IsLeader returns true if this replica holds the leader lock
+func (e *Elector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Now().Before(e.leaseEnd)
+}
+
+// Status returns the leadership state as last seen by this replica
+func (e *Elector) Status() *Status {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s := &Status{
+		Replica: e.lock.holder,
+		Leader:  time.Now().Before(e.leaseEnd),
+	}
+	if e.record.held(time.Now()) {
+		s.Holder = e.record.Holder
+		s.Since = &e.record.AcquiredAt
+		s.ExpiresAt = &e.record.ExpiresAt
+	}
+	return s
+}
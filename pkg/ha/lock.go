@@ -0,0 +1,236 @@
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// lockPrefix is where the locks are stored in the kv store
+const lockPrefix = "acpm/locks"
+
+// lockRetryInterval is the delay between attempts
+// to acquire a lock that is held by another replica
+const lockRetryInterval time.Duration = time.Second
+
+// LockRecord is the state of a lock as stored in the kv store
+type LockRecord struct {
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// held returns true if the lock is held by someone at time t
+func (lr *LockRecord) held(t time.Time) bool {
+	return lr != nil && lr.Holder != "" && t.Before(lr.ExpiresAt)
+}
+
+// Lock is a lock shared by the replicas, stored in the kv (v2) store.
+// Writes use check-and-set, so only one replica can take it at a time,
+// and it expires unless its holder renews it before the TTL ends.
+// Replicas are assumed to have their clocks in sync.
+type Lock struct {
+	client vault.AuthenticatedClient
+	kvPath string
+	name   string
+	holder string
+	ttl    time.Duration
+	logger logr.Logger
+	// local serializes the holders within this replica,
+	// which share the same holder name in the kv store
+	local chan struct{}
+}
+
+// NewLock returns the lock with the given name. holder identifies
+// this replica, and ttl is how long the lock lasts without renewals.
+func NewLock(client vault.AuthenticatedClient, kvPath, name, holder string, ttl time.Duration, logger logr.Logger) *Lock {
+	return &Lock{
+		client: client,
+		kvPath: kvPath,
+		name:   name,
+		holder: holder,
+		ttl:    ttl,
+		logger: logger.WithValues("lock", name),
+		local:  make(chan struct{}, 1),
+	}
+}
+
+func (l *Lock) path() string {
+	return fmt.Sprintf("%s/data/%s/%s", l.kvPath, lockPrefix, l.name)
+}
+
+// read returns the current record of the lock, nil if it was never
+// taken, and the version of the secret to use for check-and-set
+func (l *Lock) read(ctx context.Context) (*LockRecord, int, error) {
+	client, err := l.client.GetClient(l.logger)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.VaultApiTimeout)
+	defer cancel()
+	secret, err := client.Logical().ReadWithContext(ctx, l.path())
+	if err != nil {
+		return nil, 0, err
+	}
+	if secret == nil {
+		return nil, 0, nil
+	}
+
+	version := 0
+	if md, ok := secret.Data["metadata"].(map[string]any); ok {
+		if v, ok := md["version"].(json.Number); ok {
+			n, err := v.Int64()
+			if err != nil {
+				return nil, 0, err
+			}
+			version = int(n)
+		}
+	}
+	if secret.Data["data"] == nil {
+		return nil, version, nil
+	}
+	b, err := json.Marshal(secret.Data["data"])
+	if err != nil {
+		return nil, 0, err
+	}
+	record := &LockRecord{}
+	if err := json.Unmarshal(b, record); err != nil {
+		return nil, 0, err
+	}
+	return record, version, nil
+}
+
+// write stores the record if the secret is still at the given
+// version. It returns false if another replica wrote it first.
+func (l *Lock) write(ctx context.Context, record *LockRecord, version int) (bool, error) {
+	client, err := l.client.GetClient(l.logger)
+	if err != nil {
+		return false, err
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+	data := map[string]any{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.VaultApiTimeout)
+	defer cancel()
+	_, err = client.Logical().WriteWithContext(ctx, l.path(), map[string]any{
+		"options": map[string]any{"cas": version},
+		"data":    data,
+	})
+	var rspErr *api.ResponseError
+	if errors.As(err, &rspErr) && rspErr.StatusCode == http.StatusBadRequest &&
+		strings.Contains(strings.Join(rspErr.Errors, " "), "check-and-set") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// TryAcquire takes the lock if it is free or expired, or renews it if
+// this replica already holds it. It returns the record of the lock after
+// the attempt, and whether this replica holds it.
+func (l *Lock) TryAcquire(ctx context.Context) (*LockRecord, bool, error) {
+	current, version, err := l.read(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	now := time.Now()
+	if current.held(now) && current.Holder != l.holder {
+		return current, false, nil
+	}
+
+	record := &LockRecord{Holder: l.holder, AcquiredAt: now, ExpiresAt: now.Add(l.ttl)}
+	if current.held(now) {
+		record.AcquiredAt = current.AcquiredAt
+	}
+	ok, err := l.write(ctx, record, version)
+	if err != nil || !ok {
+		return current, false, err
+	}
+	return record, true, nil
+}
+
+// Release frees the lock if this replica holds it, so
+// other replicas don't have to wait for it to expire
+func (l *Lock) Release(ctx context.Context) error {
+	current, version, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Holder != l.holder {
+		return nil
+	}
+	current.ExpiresAt = time.Now()
+	_, err = l.write(ctx, current, version)
+	return err
+}
+
+// Lock blocks until the lock is acquired or ctx is done. The lock is
+// renewed in the background until the returned function is called.
+func (l *Lock) Lock(ctx context.Context) (func(), error) {
+	select {
+	case l.local <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		_, ok, err := l.TryAcquire(ctx)
+		if err != nil {
+			l.logger.Error(err, "unable to acquire lock, retrying")
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-time.After(lockRetryInterval):
+		case <-ctx.Done():
+			<-l.local
+			return nil, ctx.Err()
+		}
+	}
+
+	// Renew the lock until it is released. The holder is not
+	// cancelled if renewals fail, as it might be halfway through
+	// a change, so the failures are only logged.
+	renewCtx, stopRenewal := context.WithCancel(context.Background())
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, ok, err := l.TryAcquire(renewCtx); err != nil {
+					l.logger.Error(err, "unable to renew lock")
+				} else if !ok {
+					l.logger.Info("Lock expired and was taken by another replica while held")
+				}
+			case <-renewCtx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		stopRenewal()
+		<-renewed
+		if err := l.Release(context.Background()); err != nil {
+			l.logger.Error(err, "unable to release lock, it will be free once it expires")
+		}
+		<-l.local
+	}, nil
+}
@@ -0,0 +1,330 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// ErrJobNotFound is returned when there is no job with the requested ID
+var ErrJobNotFound = errors.New("job not found")
+
+// Status is the state of a job
+type Status string
+
+// States of a job
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+// idTimeLayout is the format of the time prefix of the job IDs,
+// which makes them sort in the order the jobs were created
+const idTimeLayout = "20060102T150405Z"
+
+// Job is an operation run in the background, or a
+// run of a cron job, recorded in the job history
+type Job struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	Actor      string          `json:"actor"`
+	Status     Status          `json:"status"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	StartedAt  *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Logs       []LogLine       `json:"logs,omitempty"`
+	// LogsTruncated is set when the job logged
+	// more lines than the history keeps
+	LogsTruncated bool `json:"logsTruncated,omitempty"`
+}
+
+// copy returns a copy of the job that can be used while the job runs
+func (j *Job) copy() *Job {
+	c := *j
+	c.Logs = append([]LogLine(nil), j.Logs...)
+	return &c
+}
+
+// summary returns the job without its logs and result
+func (j *Job) summary() *Job {
+	c := *j
+	c.Logs, c.Result = nil, nil
+	return &c
+}
+
+// Func is the work of a job. logger records the lines logged in the
+// job history, besides sending them to the server log. The result is
+// encoded as JSON in the job.
+type Func func(ctx context.Context, logger logr.Logger) (any, error)
+
+// Manager runs the jobs and keeps their history in the store
+type Manager struct {
+	store  Store
+	logger logr.Logger
+
+	mu sync.Mutex
+	// active are the jobs of this replica that have not finished
+	active map[string]*Job
+	// summaries are the summaries of the finished jobs in the history.
+	// Finished jobs don't change, so List reads each of them only once.
+	summaries map[string]*Job
+	wg        sync.WaitGroup
+}
+
+// NewManager returns a job manager that persists the jobs in store
+func NewManager(store Store, logger logr.Logger) *Manager {
+	return &Manager{store: store, logger: logger, active: map[string]*Job{}, summaries: map[string]*Job{}}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format(idTimeLayout) + "-" + hex.EncodeToString(b), nil
+}
+
+// create records a new queued job
+func (m *Manager) create(ctx context.Context, kind string, actor string) (*Job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{ID: id, Kind: kind, Actor: actor, Status: StatusQueued, CreatedAt: time.Now().UTC()}
+	if err := m.store.Save(ctx, job); err != nil {
+		return nil, fmt.Errorf("unable to persist job: %w", err)
+	}
+	m.mu.Lock()
+	m.active[id] = job
+	m.mu.Unlock()
+	return job, nil
+}
+
+// update changes the job while holding the lock, and
+// returns a copy of it once changed, to be persisted
+func (m *Manager) update(job *Job, change func(*Job)) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	change(job)
+	return job.copy()
+}
+
+// save persists the job. Failures are logged, as
+// the job has to go on even if its history can't.
+func (m *Manager) save(ctx context.Context, job *Job) {
+	if err := m.store.Save(context.WithoutCancel(ctx), job); err != nil {
+		m.logger.Error(err, "unable to persist job", "job", job.ID)
+	}
+}
+
+func (m *Manager) run(ctx context.Context, job *Job, fn Func) *Job {
+	m.save(ctx, m.update(job, func(j *Job) {
+		now := time.Now().UTC()
+		j.Status, j.StartedAt = StatusRunning, &now
+	}))
+
+	logger := logr.New(newRecordingSink(m.logger.GetSink(), func(l LogLine) {
+		m.update(job, func(j *Job) {
+			if len(j.Logs) >= maxLogLines {
+				j.LogsTruncated = true
+				return
+			}
+			j.Logs = append(j.Logs, l)
+		})
+	})).WithValues("job", job.ID, "kind", job.Kind)
+	result, err := fn(ctx, logger)
+
+	var encoded []byte
+	if result != nil {
+		var encErr error
+		if encoded, encErr = json.Marshal(result); encErr != nil {
+			m.logger.Error(encErr, "unable to encode the result of the job", "job", job.ID)
+		}
+	}
+	done := m.update(job, func(j *Job) {
+		now := time.Now().UTC()
+		j.Status, j.FinishedAt, j.Result = StatusSucceeded, &now, encoded
+		if err != nil {
+			j.Status, j.Error = StatusFailed, err.Error()
+		}
+	})
+	m.save(ctx, done)
+
+	m.mu.Lock()
+	delete(m.active, job.ID)
+	m.summaries[job.ID] = done.summary()
+	m.mu.Unlock()
+	return done
+}
+
+// Submit creates a job and runs it in the background. The returned job
+// is queued, use Get to follow it. ctx must not be cancelled when the
+// caller returns, unless the job has to be cancelled as well.
+func (m *Manager) Submit(ctx context.Context, kind string, actor string, fn Func) (*Job, error) {
+	job, err := m.create(ctx, kind, actor)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := job.copy()
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.run(ctx, job, fn)
+	}()
+	return snapshot, nil
+}
+
+// Run runs a job and waits for it to finish, recording it in the
+// history. It returns the finished job and the error of fn.
+func (m *Manager) Run(ctx context.Context, kind string, actor string, fn Func) (*Job, error) {
+	job, err := m.create(ctx, kind, actor)
+	if err != nil {
+		// The work is more important than its history
+		m.logger.Error(err, "running job without history", "kind", kind)
+		_, err := fn(ctx, m.logger.WithValues("kind", kind))
+		return nil, err
+	}
+	done := m.run(ctx, job, fn)
+	if done.Status == StatusFailed {
+		return done, errors.New(done.Error)
+	}
+	return done, nil
+}
+
+// Get returns the job with the given ID
+func (m *Manager) Get(ctx context.Context, id string) (*Job, error) {
+	m.mu.Lock()
+	job, ok := m.active[id]
+	if ok {
+		job = job.copy()
+	}
+	m.mu.Unlock()
+	if ok {
+		return job, nil
+	}
+	return m.store.Get(ctx, id)
+}
+
+// Query are the filters to select jobs from the
+// history. Empty fields match any job.
+type Query struct {
+	Kind  string
+	Actor string
+	// Limit returns only the latest matching jobs
+	Limit int
+}
+
+// List returns the jobs in the history that match the query, newest first.
+// The logs and results are not included, use Get to retrieve them.
+func (m *Manager) List(ctx context.Context, q *Query) ([]*Job, error) {
+	ids, err := m.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+
+	jobs := []*Job{}
+	for _, id := range ids {
+		if q.Limit > 0 && len(jobs) >= q.Limit {
+			break
+		}
+		job, err := m.summary(ctx, id)
+		if errors.Is(err, ErrJobNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if (q.Kind == "" || q.Kind == job.Kind) && (q.Actor == "" || q.Actor == job.Actor) {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// summary returns the summary of the job with the given ID. The job is
+// only read from the store if it is not finished or not summarized yet.
+func (m *Manager) summary(ctx context.Context, id string) (*Job, error) {
+	m.mu.Lock()
+	job, ok := m.active[id]
+	if ok {
+		job = job.summary()
+	} else if job, ok = m.summaries[id]; ok {
+		job = job.summary()
+	}
+	m.mu.Unlock()
+	if ok {
+		return job, nil
+	}
+
+	job, err := m.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	job = job.summary()
+	if job.Status == StatusSucceeded || job.Status == StatusFailed {
+		m.mu.Lock()
+		m.summaries[id] = job.summary()
+		m.mu.Unlock()
+	}
+	return job, nil
+}
+
+// Prune removes from the history the finished jobs
+// created before the given time. It returns how many.
+func (m *Manager) Prune(ctx context.Context, before time.Time) (int, error) {
+	ids, err := m.store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, id := range ids {
+		created, err := time.Parse(idTimeLayout, strings.SplitN(id, "-", 2)[0])
+		if err != nil || !created.Before(before) {
+			continue
+		}
+		m.mu.Lock()
+		_, active := m.active[id]
+		m.mu.Unlock()
+		if active {
+			continue
+		}
+		if err := m.store.Delete(ctx, id); err != nil {
+			return pruned, err
+		}
+		m.mu.Lock()
+		delete(m.summaries, id)
+		m.mu.Unlock()
+		pruned++
+	}
+	return pruned, nil
+}
+
+// Wait waits for the jobs running in the background
+// to finish, or until ctx is done
+func (m *Manager) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+// memoryStore keeps the jobs in memory and counts the reads
+type memoryStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	reads int
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{jobs: map[string]*Job{}}
+}
+
+func (s *memoryStore) Save(ctx context.Context, job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job.copy()
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads++
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job.copy(), nil
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []string{}
+	for id := range s.jobs {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, id)
+	return nil
+}
+
+func TestListReadsFinishedJobsOnce(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+
+	// Jobs run by another replica are only in the store
+	other := NewManager(store, logr.Discard())
+	for i := 0; i < 3; i++ {
+		if _, err := other.Run(ctx, "crl.rotate", "system/cron", func(ctx context.Context, logger logr.Logger) (any, error) {
+			return map[string]string{"crl": "..."}, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := other.Run(ctx, "crl.update", "alice", func(ctx context.Context, logger logr.Logger) (any, error) {
+		return nil, errors.New("failed")
+	}); err == nil {
+		t.Fatal("Run() = nil, want the error of the job")
+	}
+
+	m := NewManager(store, logr.Discard())
+	for i := 0; i < 2; i++ {
+		list, err := m.List(ctx, &Query{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 4 {
+			t.Fatalf("List() returned %d jobs, want 4", len(list))
+		}
+		for _, job := range list {
+			if job.Result != nil || job.Logs != nil {
+				t.Errorf("List() returned job %s with its result or logs", job.ID)
+			}
+		}
+	}
+	if store.reads != 4 {
+		t.Errorf("List() read %d jobs from the store, want 4", store.reads)
+	}
+
+	list, err := m.List(ctx, &Query{Actor: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Status != StatusFailed {
+		t.Errorf("List() = %v, want the failed job of alice", list)
+	}
+}
@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// maxLogLines is how many lines of each job are kept in the history
+const maxLogLines = 500
+
+// LogLine is a line logged by a job
+type LogLine struct {
+	Time    time.Time         `json:"time"`
+	Message string            `json:"message"`
+	Error   string            `json:"error,omitempty"`
+	Values  map[string]string `json:"values,omitempty"`
+}
+
+// recordingSink passes the log lines to the underlying sink and records
+// them in the job. Only the info lines of level 0 and the errors are
+// recorded, the debug ones are too verbose for the job history.
+type recordingSink struct {
+	sink   logr.LogSink
+	record func(LogLine)
+}
+
+var _ logr.CallDepthLogSink = &recordingSink{}
+
+// newRecordingSink returns a sink that records the lines in the job
+// and passes them to sink, which can be nil to only record them
+func newRecordingSink(sink logr.LogSink, record func(LogLine)) *recordingSink {
+	// Account for this sink in the call stack
+	if cd, ok := sink.(logr.CallDepthLogSink); ok {
+		sink = cd.WithCallDepth(1)
+	}
+	return &recordingSink{sink: sink, record: record}
+}
+
+func newLogLine(msg string, err error, keysAndValues []any) LogLine {
+	l := LogLine{Time: time.Now().UTC(), Message: msg}
+	if err != nil {
+		l.Error = err.Error()
+	}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		if l.Values == nil {
+			l.Values = map[string]string{}
+		}
+		l.Values[fmt.Sprint(keysAndValues[i])] = fmt.Sprint(keysAndValues[i+1])
+	}
+	return l
+}
+
+// Init does nothing, the underlying sink is already initialized
+func (rs *recordingSink) Init(info logr.RuntimeInfo) {}
+
+func (rs *recordingSink) Enabled(level int) bool {
+	return level == 0 || (rs.sink != nil && rs.sink.Enabled(level))
+}
+
+func (rs *recordingSink) Info(level int, msg string, keysAndValues ...any) {
+	if level == 0 {
+		rs.record(newLogLine(msg, nil, keysAndValues))
+	}
+	if rs.sink != nil && rs.sink.Enabled(level) {
+		rs.sink.Info(level, msg, keysAndValues...)
+	}
+}
+
+func (rs *recordingSink) Error(err error, msg string, keysAndValues ...any) {
+	rs.record(newLogLine(msg, err, keysAndValues))
+	if rs.sink != nil {
+		rs.sink.Error(err, msg, keysAndValues...)
+	}
+}
+
+func (rs *recordingSink) WithValues(keysAndValues ...any) logr.LogSink {
+	c := *rs
+	if rs.sink != nil {
+		c.sink = rs.sink.WithValues(keysAndValues...)
+	}
+	return &c
+}
+
+func (rs *recordingSink) WithName(name string) logr.LogSink {
+	c := *rs
+	if rs.sink != nil {
+		c.sink = rs.sink.WithName(name)
+	}
+	return &c
+}
+
+func (rs *recordingSink) WithCallDepth(depth int) logr.LogSink {
+	c := *rs
+	if cd, ok := rs.sink.(logr.CallDepthLogSink); ok {
+		c.sink = cd.WithCallDepth(depth)
+	}
+	return &c
+}
@@ -0,0 +1,118 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/vault"
+	"github.com/go-logr/logr"
+)
+
+// Store persists the job history
+type Store interface {
+	Save(ctx context.Context, job *Job) error
+	// Get returns ErrJobNotFound if the job is not stored
+	Get(ctx context.Context, id string) (*Job, error)
+	// List returns the IDs of the stored jobs, in any order
+	List(ctx context.Context) ([]string, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// jobsPrefix is where the jobs are stored in the kv store
+const jobsPrefix = "acpm/jobs"
+
+// VaultStore stores each job as a secret in the kv
+// (v2) store, under the "acpm/jobs/" prefix
+type VaultStore struct {
+	client vault.AuthenticatedClient
+	kvPath string
+	logger logr.Logger
+}
+
+// NewVaultStore returns a store that keeps the jobs in the kv store at kvPath
+func NewVaultStore(client vault.AuthenticatedClient, kvPath string, logger logr.Logger) *VaultStore {
+	return &VaultStore{client: client, kvPath: kvPath, logger: logger}
+}
+
+// Save writes the job, replacing the previous version of it
+func (vs *VaultStore) Save(ctx context.Context, job *Job) error {
+	client, err := vs.client.GetClient(vs.logger)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	data := map[string]any{}
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.VaultApiTimeout)
+	defer cancel()
+	_, err = client.Logical().WriteWithContext(ctx, fmt.Sprintf("%s/data/%s/%s", vs.kvPath, jobsPrefix, job.ID),
+		map[string]any{"data": data})
+	return err
+}
+
+// Get reads the job with the given ID
+func (vs *VaultStore) Get(ctx context.Context, id string) (*Job, error) {
+	client, err := vs.client.GetClient(vs.logger)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.VaultApiTimeout)
+	defer cancel()
+	secret, err := client.Logical().ReadWithContext(ctx, fmt.Sprintf("%s/data/%s/%s", vs.kvPath, jobsPrefix, id))
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data["data"] == nil {
+		return nil, ErrJobNotFound
+	}
+	b, err := json.Marshal(secret.Data["data"])
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(b, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// List returns the IDs of all the jobs in the kv store
+func (vs *VaultStore) List(ctx context.Context) ([]string, error) {
+	client, err := vs.client.GetClient(vs.logger)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.VaultApiTimeout)
+	defer cancel()
+	secret, err := client.Logical().ListWithContext(ctx, fmt.Sprintf("%s/metadata/%s", vs.kvPath, jobsPrefix))
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	if secret == nil || secret.Data["keys"] == nil {
+		return ids, nil
+	}
+	for _, k := range secret.Data["keys"].([]any) {
+		ids = append(ids, k.(string))
+	}
+	return ids, nil
+}
+
+// Delete removes the job and all its versions
+func (vs *VaultStore) Delete(ctx context.Context, id string) error {
+	client, err := vs.client.GetClient(vs.logger)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.VaultApiTimeout)
+	defer cancel()
+	_, err = client.Logical().DeleteWithContext(ctx, fmt.Sprintf("%s/metadata/%s/%s", vs.kvPath, jobsPrefix, id))
+	return err
+}
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "acpm"
+
+var (
+	// HTTPRequests counts the requests served by the API
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Requests served by the API, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	// HTTPRequestDuration observes the latency of the requests served by the API
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the requests served by the API, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// VaultRequestDuration observes the latency of the calls to Vault
+	VaultRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "vault_request_duration_seconds",
+		Help:      "Latency of the calls to the Vault API, by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	// VaultRequestErrors counts the failed calls to Vault
+	VaultRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "vault_request_errors_total",
+		Help:      "Calls to the Vault API that failed, by method. Not found responses are not errors.",
+	}, []string{"method"})
+
+	// AWSRequestDuration observes the latency of the calls to AWS
+	AWSRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "aws_request_duration_seconds",
+		Help:      "Latency of the calls to AWS APIs, including retries, by service and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service", "operation"})
+
+	// AWSRequestErrors counts the failed calls to AWS
+	AWSRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "aws_request_errors_total",
+		Help:      "Calls to AWS APIs that failed, by service and operation.",
+	}, []string{"service", "operation"})
+
+	// Certificates is the number of client certificates in each state
+	Certificates = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "certificates",
+		Help:      "Client certificates by state (active, revoked, expired).",
+	}, []string{"state"})
+
+	// NextCertificateExpiryDays is the remaining lifetime
+	// of the active certificate that expires first
+	NextCertificateExpiryDays = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "next_certificate_expiry_days",
+		Help:      "Days until the next active client certificate expires.",
+	})
+
+	// UsersWithMultipleActiveCertificates is the number of users that
+	// hold more than one active certificate for the same device
+	UsersWithMultipleActiveCertificates = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "users_with_multiple_active_certificates",
+		Help:      "Users with more than one active client certificate for the same device.",
+	})
+
+	// Leader is 1 if this replica is the leader in HA mode
+	Leader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "1 if this replica is the leader that runs the scheduled jobs, 0 otherwise.",
+	})
+
+	// CRLNextUpdate is the NextUpdate of the CRLs in Vault and in the Client VPN endpoint
+	CRLNextUpdate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "crl_next_update_timestamp_seconds",
+		Help:      "NextUpdate of the CRL, by source (vault, endpoint).",
+	}, []string{"source"})
+
+	// CronLastSuccess is the time of the last successful run of each cron job
+	CronLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cron_last_success_timestamp_seconds",
+		Help:      "Time of the last successful run of each cron job.",
+	}, []string{"job"})
+
+	// AuthCacheRequests counts the lookups in the auth cache
+	AuthCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_cache_requests_total",
+		Help:      "Lookups in the auth cache, by result (hit, stale_hit, miss).",
+	}, []string{"result"})
+)
+
+// vaultTransport records the latency and errors of the calls to Vault
+type vaultTransport struct {
+	next http.RoundTripper
+}
+
+// InstrumentVault wraps the transport of the Vault client to record metrics
+func InstrumentVault(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &vaultTransport{next: next}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *vaultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	rsp, err := t.next.RoundTrip(req)
+	VaultRequestDuration.WithLabelValues(req.Method).Observe(time.Since(start).Seconds())
+	// Vault answers with a 404 when a secret does not exist, which is expected
+	if err != nil || (rsp.StatusCode >= 400 && rsp.StatusCode != http.StatusNotFound) {
+		VaultRequestErrors.WithLabelValues(req.Method).Inc()
+	}
+	return rsp, err
+}
+
+// InstrumentAWS adds a middleware to the stack of the AWS clients that
+// records the latency and errors of each call. Use it in the APIOptions
+// of the AWS config.
+func InstrumentAWS(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("ACPMMetrics",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (
+			middleware.InitializeOutput, middleware.Metadata, error,
+		) {
+			start := time.Now()
+			out, md, err := next.HandleInitialize(ctx, in)
+			service, operation := awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx)
+			AWSRequestDuration.WithLabelValues(service, operation).Observe(time.Since(start).Seconds())
+			if err != nil {
+				AWSRequestErrors.WithLabelValues(service, operation).Inc()
+			}
+			return out, md, err
+		}), middleware.After)
+}
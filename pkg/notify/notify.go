@@ -0,0 +1,104 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Alert represents a condition that
+// requires the attention of an operator
+type Alert struct {
+	Summary string            `json:"summary"`
+	Details map[string]string `json:"details,omitempty"`
+	Time    time.Time         `json:"time"`
+}
+
+// Notifier represents anything that is able
+// to deliver alerts to an operator
+type Notifier interface {
+	Notify(context.Context, *Alert) error
+}
+
+// LogNotifier writes the alerts to the log
+type LogNotifier struct {
+	Logger logr.Logger
+}
+
+// Notify logs the alert
+func (ln *LogNotifier) Notify(ctx context.Context, alert *Alert) error {
+	keys := []any{"alert", alert.Summary}
+	for k, v := range alert.Details {
+		keys = append(keys, k, v)
+	}
+	ln.Logger.Info("ALERT: "+alert.Summary, keys...)
+	return nil
+}
+
+// WebhookNotifier posts the alerts as JSON to a webhook URL. A "text" field
+// is added to the payload so the webhook is compatible with Slack and
+// other chat tools that accept incoming webhooks.
+type WebhookNotifier struct {
+	URL string
+	// Client should have a timeout, so a webhook that doesn't
+	// answer doesn't block the caller. http.DefaultClient is
+	// used if nil.
+	Client *http.Client
+}
+
+// Notify sends the alert to the webhook
+func (wn *WebhookNotifier) Notify(ctx context.Context, alert *Alert) error {
+	payload := struct {
+		Text string `json:"text"`
+		*Alert
+	}{
+		Text:  alert.Summary,
+		Alert: alert,
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := wn.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status code %d", rsp.StatusCode)
+	}
+
+	return nil
+}
+
+// MultiNotifier delivers each alert
+// to all the configured notifiers
+type MultiNotifier []Notifier
+
+// Notify sends the alert to all notifiers, returning
+// the last error found, if any
+func (mn MultiNotifier) Notify(ctx context.Context, alert *Alert) error {
+	var err error
+	for _, n := range mn {
+		if nerr := n.Notify(ctx, alert); nerr != nil {
+			err = nerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,173 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// lastSeenKey is the key in the kv store where the
+// last-seen timestamps of the users are persisted
+const lastSeenKey = "acpm/last-seen"
+
+type lastSeenTimestamps struct {
+	Users map[string]time.Time `json:"users"`
+}
+
+// ListUserActivityRequest is the structure containing
+// the required data to retrieve the activity of the users
+type ListUserActivityRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	VaultKVPath         string
+	ClientVPNEndpointID string
+}
+
+// ListUserActivity merges the list of users and certificates with the connections
+// reported by the AWS Client VPN endpoint. The last time each user was seen connected
+// to the VPN is read from the kv store, where RefreshUserActivity persists it, so it
+// is kept even after AWS stops reporting the connection. Nothing is written.
+func ListUserActivity(ctx context.Context, r *ListUserActivityRequest, logger logr.Logger) (map[string]*UserActivity, error) {
+	activity, observed, err := userActivity(ctx, r, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	persisted, err := getLastSeen(ctx, r.Client, r.VaultKVPath)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to read %s/data/%s from KV2 store", r.VaultKVPath, lastSeenKey))
+		return nil, err
+	}
+	mergeLastSeen(activity, persisted, observed)
+
+	return activity, nil
+}
+
+// RefreshUserActivity persists the last time each user has been
+// seen connected to the VPN, as reported by the AWS Client VPN endpoint
+func RefreshUserActivity(ctx context.Context, r *ListUserActivityRequest, logger logr.Logger) error {
+	_, observed, err := userActivity(ctx, r, logger)
+	if err != nil {
+		return err
+	}
+
+	if err := updateLastSeen(ctx, r.Client, r.VaultKVPath, observed); err != nil {
+		logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, lastSeenKey))
+		return err
+	}
+	return nil
+}
+
+// userActivity returns the activity of the users together with
+// the last time each of them has been seen in the connections
+// reported by the AWS Client VPN endpoint
+func userActivity(ctx context.Context, r *ListUserActivityRequest, logger logr.Logger) (map[string]*UserActivity, map[string]time.Time, error) {
+	activity := map[string]*UserActivity{}
+
+	users, err := ListUsers(ctx,
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+		}, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	for username, crts := range users {
+		activity[username] = &UserActivity{Certificates: crts, Connections: []Connection{}}
+	}
+
+	awsCtx, cancel := context.WithTimeout(ctx, config.AwsApiTimeout)
+	defer cancel()
+	cfg, err := awsconfig.LoadDefaultConfig(awsCtx, awsconfig.WithAPIOptions(awsAPIOptions))
+	if err != nil {
+		logger.Error(err, "unable to load AWS EC2 client")
+		return nil, nil, err
+	}
+	conns, err := describeConnections(awsCtx, ec2.NewFromConfig(cfg), r.ClientVPNEndpointID)
+	if err != nil {
+		logger.Error(err, "error in AWS call to describeClientVpnConnections")
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	observed := map[string]time.Time{}
+	for _, conn := range conns {
+		username, _ := parseCommonName(conn.CommonName)
+		if _, ok := activity[username]; !ok {
+			activity[username] = &UserActivity{Certificates: []Certificate{}, Connections: []Connection{}}
+		}
+		activity[username].Connections = append(activity[username].Connections, conn)
+
+		seen := conn.EndTime
+		if conn.Status == string(types.ClientVpnConnectionStatusCodeActive) {
+			activity[username].Connected = true
+			seen = now
+		}
+		if seen.IsZero() {
+			seen = conn.EstablishedTime
+		}
+		if seen.After(observed[username]) {
+			observed[username] = seen
+		}
+	}
+
+	return activity, observed, nil
+}
+
+// mergeLastSeen sets the last-seen timestamp of each user to the
+// latest between the persisted and the observed ones
+func mergeLastSeen(activity map[string]*UserActivity, persisted, observed map[string]time.Time) {
+	for username, ua := range activity {
+		lastSeen, ok := persisted[username]
+		if t, seen := observed[username]; seen && (!ok || t.After(lastSeen)) {
+			lastSeen, ok = t, true
+		}
+		if ok {
+			ua.LastSeen = &lastSeen
+		}
+	}
+}
+
+// getLastSeen reads the persisted last-seen timestamps. Users
+// that have never been seen connected to the VPN are not in it.
+func getLastSeen(ctx context.Context, client *api.Client, kvPath string) (map[string]time.Time, error) {
+	data := lastSeenTimestamps{}
+	if _, err := readKVData(ctx, client, kvPath, lastSeenKey, &data); err != nil {
+		return nil, err
+	}
+	if data.Users == nil {
+		return map[string]time.Time{}, nil
+	}
+	return data.Users, nil
+}
+
+// updateLastSeen persists the observed last-seen timestamps in a
+// single write, keeping the persisted ones that are later
+func updateLastSeen(ctx context.Context, client *api.Client, kvPath string, observed map[string]time.Time) error {
+	return updateKVData(ctx, client, kvPath, lastSeenKey, func(data *lastSeenTimestamps) error {
+		changed := false
+		for username, t := range observed {
+			t = t.UTC().Truncate(time.Second)
+			if stored, ok := data.Users[username]; ok && !t.After(stored) {
+				continue
+			}
+			if data.Users == nil {
+				data.Users = map[string]time.Time{}
+			}
+			data.Users[username] = t
+			changed = true
+		}
+		if !changed {
+			return errKVUnchanged
+		}
+		return nil
+	})
+}
@@ -0,0 +1,67 @@
+package operations
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUpdateLastSeenKeepsTheLatestTimestamps(t *testing.T) {
+	kv, client := newFakeKV(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	if err := updateLastSeen(ctx, client, "secret", map[string]time.Time{
+		"alice": now,
+		"bob":   now.Add(-time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// alice was seen earlier than the persisted timestamp
+	if err := updateLastSeen(ctx, client, "secret", map[string]time.Time{
+		"alice": now.Add(-time.Hour),
+		"bob":   now,
+		"carol": now,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := kv.writeCount(); n != 2 {
+		t.Errorf("got %d writes, want one per update", n)
+	}
+
+	// Nothing newer than the persisted timestamps
+	if err := updateLastSeen(ctx, client, "secret", map[string]time.Time{"alice": now}); err != nil {
+		t.Fatal(err)
+	}
+	if n := kv.writeCount(); n != 2 {
+		t.Errorf("got %d writes, want no write when nothing changed", n)
+	}
+
+	got, err := getLastSeen(ctx, client, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if !got[username].Equal(now) {
+			t.Errorf("last seen of %s = %s, want %s", username, got[username], now)
+		}
+	}
+}
+
+func TestMergeLastSeen(t *testing.T) {
+	now := time.Now()
+	activity := map[string]*UserActivity{"alice": {}, "bob": {}, "carol": {}, "dave": {}}
+	mergeLastSeen(activity,
+		map[string]time.Time{"alice": now, "bob": now.Add(-time.Hour)},
+		map[string]time.Time{"alice": now.Add(-time.Hour), "bob": now, "carol": now},
+	)
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if ls := activity[username].LastSeen; ls == nil || !ls.Equal(now) {
+			t.Errorf("last seen of %s = %v, want %s", username, ls, now)
+		}
+	}
+	if ls := activity["dave"].LastSeen; ls != nil {
+		t.Errorf("last seen of dave = %s, want none", ls)
+	}
+}
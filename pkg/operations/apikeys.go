@@ -0,0 +1,206 @@
+package operations
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// apiKeysKey is the key in the kv store where the API keys are persisted
+const apiKeysKey = "acpm/apikeys"
+
+// APIKeyPrefix is the prefix of all the API keys, used to tell
+// them apart from the tokens of the other auth backends
+const APIKeyPrefix = "acpm_"
+
+var (
+	// ErrInvalidAPIKey is returned when an API key does
+	// not exist, has been revoked or has expired
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	// ErrInvalidAPIKeyRequest is returned when the
+	// name or the expiry of a new API key are not valid
+	ErrInvalidAPIKeyRequest = errors.New("invalid API key request")
+	// ErrAPIKeyNotFound is returned when revoking an API key that does not exist
+	ErrAPIKeyNotFound = errors.New("API key not found")
+
+	apiKeyNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+)
+
+type apiKeys struct {
+	Keys map[string]APIKey `json:"keys"`
+}
+
+// getAPIKeys reads the API keys from the kv store
+func getAPIKeys(ctx context.Context, client *api.Client, kvPath string) (map[string]APIKey, error) {
+	data := apiKeys{}
+	if _, err := readKVData(ctx, client, kvPath, apiKeysKey, &data); err != nil {
+		return nil, err
+	}
+	if data.Keys == nil {
+		return map[string]APIKey{}, nil
+	}
+	return data.Keys, nil
+}
+
+// hashAPIKeySecret returns the hex encoded sha256 hash of the secret
+// part of a key. The secrets are random, so a salt is not required.
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKeyRequest is the structure containing
+// the required data to create an API key
+type CreateAPIKeyRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+	Name        string
+	Scopes      []string
+	ExpiresAt   time.Time
+	CreatedBy   string
+}
+
+// CreateAPIKey generates a new API key. It returns the key, which
+// is not stored anywhere and can't be retrieved later, and its metadata.
+func CreateAPIKey(ctx context.Context, r *CreateAPIKeyRequest, logger logr.Logger) (string, *APIKey, error) {
+	if !apiKeyNameRegexp.MatchString(r.Name) {
+		return "", nil, fmt.Errorf("%w: name '%s' is not valid, only letters, numbers, '.', '_' and '-' are allowed", ErrInvalidAPIKeyRequest, r.Name)
+	}
+	if !r.ExpiresAt.After(time.Now()) {
+		return "", nil, fmt.Errorf("%w: expiry %s is not in the future", ErrInvalidAPIKeyRequest, r.ExpiresAt)
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	key := APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      r.Name,
+		Scopes:    r.Scopes,
+		ExpiresAt: r.ExpiresAt,
+		CreatedAt: time.Now(),
+		CreatedBy: r.CreatedBy,
+		Hash:      hashAPIKeySecret(hex.EncodeToString(secret)),
+	}
+	err := updateKVData(ctx, r.Client, r.VaultKVPath, apiKeysKey, func(data *apiKeys) error {
+		if data.Keys == nil {
+			data.Keys = map[string]APIKey{}
+		}
+		data.Keys[key.ID] = key
+		return nil
+	})
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, apiKeysKey))
+		return "", nil, err
+	}
+	logger.Info(fmt.Sprintf("Created API key %s (%s)", key.ID, key.Name))
+
+	key.Hash = ""
+	return APIKeyPrefix + key.ID + "_" + hex.EncodeToString(secret), &key, nil
+}
+
+// ListAPIKeysRequest is the structure containing
+// the required data to list the API keys
+type ListAPIKeysRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+}
+
+// ListAPIKeys returns the metadata of the API keys, sorted by creation date
+func ListAPIKeys(ctx context.Context, r *ListAPIKeysRequest, logger logr.Logger) ([]APIKey, error) {
+	keys, err := getAPIKeys(ctx, r.Client, r.VaultKVPath)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to read %s/data/%s from KV2 store", r.VaultKVPath, apiKeysKey))
+		return nil, err
+	}
+	list := make([]APIKey, 0, len(keys))
+	for _, k := range keys {
+		k.Hash = ""
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+// RevokeAPIKeyRequest is the structure containing
+// the required data to revoke an API key
+type RevokeAPIKeyRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+	ID          string
+}
+
+// RevokeAPIKey deletes an API key, so it can no longer be used
+func RevokeAPIKey(ctx context.Context, r *RevokeAPIKeyRequest, logger logr.Logger) (*APIKey, error) {
+	var key APIKey
+	err := updateKVData(ctx, r.Client, r.VaultKVPath, apiKeysKey, func(data *apiKeys) error {
+		var ok bool
+		if key, ok = data.Keys[r.ID]; !ok {
+			return fmt.Errorf("%w: %s", ErrAPIKeyNotFound, r.ID)
+		}
+		delete(data.Keys, r.ID)
+		return nil
+	})
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, apiKeysKey))
+		return nil, err
+	}
+	logger.Info(fmt.Sprintf("Revoked API key %s (%s)", key.ID, key.Name))
+
+	key.Hash = ""
+	return &key, nil
+}
+
+// VerifyAPIKeyRequest is the structure containing
+// the required data to verify an API key
+type VerifyAPIKeyRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+	Key         string
+}
+
+// VerifyAPIKey checks that the API key exists and has not expired,
+// and returns its metadata
+func VerifyAPIKey(ctx context.Context, r *VerifyAPIKeyRequest, logger logr.Logger) (*APIKey, error) {
+	id, secret, found := strings.Cut(strings.TrimPrefix(r.Key, APIKeyPrefix), "_")
+	if !strings.HasPrefix(r.Key, APIKeyPrefix) || !found {
+		return nil, fmt.Errorf("%w: malformed key", ErrInvalidAPIKey)
+	}
+
+	keys, err := getAPIKeys(ctx, r.Client, r.VaultKVPath)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to read %s/data/%s from KV2 store", r.VaultKVPath, apiKeysKey))
+		return nil, err
+	}
+	key, ok := keys[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashAPIKeySecret(secret))) != 1 {
+		return nil, fmt.Errorf("%w: unknown key", ErrInvalidAPIKey)
+	}
+	if !time.Now().Before(key.ExpiresAt) {
+		return nil, fmt.Errorf("%w: key %s expired at %s", ErrInvalidAPIKey, key.ID, key.ExpiresAt)
+	}
+
+	key.Hash = ""
+	return &key, nil
+}
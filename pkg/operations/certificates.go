@@ -3,11 +3,13 @@ package operations
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"path"
+	"sort"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
@@ -20,78 +22,189 @@ import (
 // IssueCertificateRequest is the structure containing
 // the required data to issue a new certificate
 type IssueCertificateRequest struct {
-	Client              *api.Client
-	VaultPKIPaths       []string
-	Username            string
+	Client        *api.Client
+	VaultPKIPaths []string
+	Username      string
+	// Device is the device the certificate is issued for. Each
+	// device of a user keeps its own active certificate.
+	Device              string
 	VaultPKIRole        string
 	ClientVPNEndpointID string
 	VaultKVPath         string
 	VaultKVConfigKey    string
 	CfgTplPath          string
+	MaxRevocations      int
+	// GracePeriod keeps the previous certificates of the user
+	// valid for the given time, so the user has time to install
+	// the new config. Zero means they are revoked right away.
+	GracePeriod time.Duration
+	// MaxDevices is the maximum number of devices with an
+	// active certificate a user can have. Zero means no limit.
+	MaxDevices int
+	// AccessExpiresAt schedules the revocation of the user at the given
+	// time. Zero keeps any previously scheduled expiration.
+	AccessExpiresAt time.Time
 }
 
-// IssueClientCertificate generates a new certificate for a given users, causing
-// the revocation of other certificates emitted for that same user
-func IssueClientCertificate(r *IssueCertificateRequest, logger logr.Logger) (string, error) {
+// IssueCertificateResponse is the structure containing
+// the result of a certificate issuance
+type IssueCertificateResponse struct {
+	Config       string
+	SerialNumber string
+	// Revoked are the serial numbers of the certificates
+	// revoked because of the new certificate
+	Revoked []string
+	// Skipped are the serial numbers of the older certificates not
+	// revoked by the CRL update because of the revocation limit
+	Skipped []string
+}
+
+// IssueClientCertificate generates a new certificate for a given user and device, causing
+// the revocation of other certificates emitted for that same user and device. If the CRL
+// update skipped the previous certificates of the device because of the revocation limit,
+// they are still valid, so the response is returned along with a RevocationLimitError.
+func IssueClientCertificate(ctx context.Context, r *IssueCertificateRequest, logger logr.Logger) (*IssueCertificateResponse, error) {
+
+	if err := validateUsername(r.Username); err != nil {
+		return nil, err
+	}
+	if err := validateDeviceName(r.Device); err != nil {
+		return nil, err
+	}
+	device := deviceOrDefault(r.Device)
+	if !r.AccessExpiresAt.IsZero() && !r.AccessExpiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: %s is not in the future", ErrInvalidAccessExpiration, r.AccessExpiresAt)
+	}
+
+	// Concurrent issues for the same user would revoke each other's certificates
+	unlock, err := lockUser(ctx, r.Username)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Get the certificates the user has for each device
+	// before issuing the new one
+	users, err := ListUsers(ctx,
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPaths[len(r.VaultPKIPaths)-1],
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+		}, logger)
+	if err != nil {
+		return nil, err
+	}
+	devices := activeDevices(users[r.Username])
+	if _, ok := devices[device]; !ok && r.MaxDevices > 0 && len(devices) >= r.MaxDevices {
+		return nil, fmt.Errorf("%w: user %s already has %d devices", ErrDeviceQuotaExceeded, r.Username, len(devices))
+	}
 
 	// Init the struct to pass to the config.ovpn.tpl template
 	data := struct {
 		DNSName     string
 		Username    string
+		Device      string
 		CA          string
 		Certificate string
 		PrivateKey  string
 	}{
 		Username: r.Username,
+		Device:   device,
+	}
+
+	// Defer the revocation of the previous certificates of the device
+	// until the grace period ends. Any revocation deferred by a previous
+	// issuance is replaced. They are deferred before the new certificate
+	// is issued, as a CRL update running in between, like the one of the
+	// cron or of another user, would revoke them right away otherwise.
+	pending := []PendingRevocation{}
+	if r.GracePeriod > 0 {
+		revokeAt := time.Now().Add(r.GracePeriod)
+		for _, crt := range devices[device] {
+			pending = append(pending, PendingRevocation{
+				SerialNumber: crt.SerialNumber,
+				SubjectCN:    crt.SubjectCN,
+				Username:     r.Username,
+				Device:       device,
+				RevokeAt:     revokeAt,
+			})
+		}
+	}
+	sameDevice := func(pr PendingRevocation) bool {
+		return pr.Username == r.Username && pr.Device == device
+	}
+	previous := []PendingRevocation{}
+	if len(pending) > 0 {
+		revocations, err := getPendingRevocations(ctx, r.Client, r.VaultKVPath)
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("unable to read %s/data/%s from KV2 store", r.VaultKVPath, pendingRevocationsKey))
+			return nil, err
+		}
+		for _, pr := range revocations {
+			if sameDevice(pr) {
+				previous = append(previous, pr)
+			}
+		}
+		if err := replacePendingRevocations(ctx, r.Client, r.VaultKVPath, sameDevice, pending); err != nil {
+			logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, pendingRevocationsKey))
+			return nil, err
+		}
+		for _, pr := range pending {
+			logger.Info(fmt.Sprintf("Revocation of cert %s/%s deferred until %s", pr.SubjectCN, pr.SerialNumber, pr.RevokeAt))
+		}
 	}
 
 	// Issue a new certificate
 	payload := make(map[string]interface{})
-	payload["common_name"] = r.Username
-	crt, err := r.Client.Logical().Write(fmt.Sprintf("%s/issue/%s", r.VaultPKIPaths[len(r.VaultPKIPaths)-1], r.VaultPKIRole), payload)
+	payload["common_name"] = commonName(r.Username, device)
+	crt, err := vaultWrite(ctx, r.Client, fmt.Sprintf("%s/issue/%s", r.VaultPKIPaths[len(r.VaultPKIPaths)-1], r.VaultPKIRole), payload)
 	if err != nil {
 		logger.Error(err, "error issuing new certificate")
-		return "", err
+		// Nothing replaces the previous certificates, so
+		// their revocations are deferred as they were
+		if len(pending) > 0 {
+			if err := replacePendingRevocations(context.WithoutCancel(ctx), r.Client, r.VaultKVPath, sameDevice, previous); err != nil {
+				logger.Error(err, fmt.Sprintf("unable to restore %s/data/%s in KV2 store", r.VaultKVPath, pendingRevocationsKey))
+			}
+		}
+		return nil, err
 	}
 	data.Certificate = crt.Data["certificate"].(string)
 	data.PrivateKey = crt.Data["private_key"].(string)
-	logger.Info(fmt.Sprintf("Issued certificate %s", crt.Data["serial_number"]))
+	serial := crt.Data["serial_number"].(string)
+	logger.Info(fmt.Sprintf("Issued certificate %s", serial))
+
+	// The certificate exists now, so the config and the revocation of the
+	// previous certificates are completed even if the caller goes away
+	ctx = context.WithoutCancel(ctx)
 
 	// Get the full CA chain of certificates from Vault
 	// (the VPN config needs the full CA chain to the root CA in it)
 	var caCerts []string
 	for _, path := range r.VaultPKIPaths {
-		ctx, cancel := context.WithTimeout(context.Background(), config.VaultApiTimeout)
-		defer cancel()
-		rsp, err := r.Client.Logical().ReadRawWithContext(ctx, fmt.Sprintf("/%s/ca/pem", path))
+		ca, err := vaultReadRaw(ctx, r.Client, fmt.Sprintf("/%s/ca/pem", path))
 		if err != nil {
 			logger.Error(err, "unable to retrieve CA for "+path)
-			return "", err
-		}
-		defer rsp.Body.Close()
-		ca, err := io.ReadAll(rsp.Body)
-		if err != nil {
-			logger.Error(err, fmt.Sprintf("error while reading /v1/%s/ca/pem", path))
-			return "", err
+			return nil, err
 		}
 		caCerts = append(caCerts, string(ca))
 	}
 	data.CA = strings.Join(caCerts, "\n")
 
 	// Get the VPN's DNS name from EC2 API
-	ctx, cancel := context.WithTimeout(context.Background(), config.AwsApiTimeout)
+	awsCtx, cancel := context.WithTimeout(ctx, config.AwsApiTimeout)
 	defer cancel()
-	cfg, err := awsconfig.LoadDefaultConfig(ctx)
+	cfg, err := awsconfig.LoadDefaultConfig(awsCtx, awsconfig.WithAPIOptions(awsAPIOptions))
 	if err != nil {
 		logger.Error(err, "unable to load AWS EC2 client")
-		return "", err
+		return nil, err
 	}
 	svc := ec2.NewFromConfig(cfg)
-	rsp, err := svc.DescribeClientVpnEndpoints(ctx,
+	rsp, err := svc.DescribeClientVpnEndpoints(awsCtx,
 		&ec2.DescribeClientVpnEndpointsInput{ClientVpnEndpointIds: []string{r.ClientVPNEndpointID}})
 	if err != nil {
 		logger.Error(err, "error in AWS call to describeClientVpnEndpointsInput")
-		return "", err
+		return nil, err
 	}
 	// AWS returns the DNSName with an asterisk at the beginning, meaning that any subdomain
 	// of the VPN's endpoint domain is valid. We need to strip this from the dns to use it
@@ -102,59 +215,196 @@ func IssueClientCertificate(r *IssueCertificateRequest, logger logr.Logger) (str
 	tpl, err := template.New(path.Base(r.CfgTplPath)).ParseFiles(r.CfgTplPath)
 	if err != nil {
 		logger.Error(err, "unable to load config.ovpn template")
-		return "", err
+		return nil, err
 	}
 	var config bytes.Buffer
 	if err := tpl.Execute(&config, data); err != nil {
 		logger.Error(err, "unable to resolve config.ovpn template")
-		return "", err
+		return nil, err
 	}
 
 	// create/update the vpn config in the kv store
 	payload["data"] = map[string]string{
 		"content": config.String(),
 	}
-	_, err = r.Client.Logical().Write(fmt.Sprintf("%s/data/users/%s/%s", r.VaultKVPath, r.Username, r.VaultKVConfigKey), payload)
+	key := configKey(r.Username, device, r.VaultKVConfigKey)
+	_, err = vaultWrite(ctx, r.Client, fmt.Sprintf("%s/data/%s", r.VaultKVPath, key), payload)
 	if err != nil {
-		logger.Error(err, fmt.Sprintf("unable to update %s/data/users/%s/%s in KV2 store", r.VaultKVPath, r.Username, r.VaultKVConfigKey))
-		return "", err
+		logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, key))
+		return nil, err
+	}
+
+	// Without a grace period, any revocation deferred by a
+	// previous issuance is removed, so nothing is kept valid
+	if len(pending) == 0 {
+		err = replacePendingRevocations(ctx, r.Client, r.VaultKVPath, sameDevice, pending)
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, pendingRevocationsKey))
+			return nil, err
+		}
+	}
+
+	// Schedule the end of the user's access
+	if !r.AccessExpiresAt.IsZero() {
+		err = setAccessExpiration(ctx, r.Client, r.VaultKVPath, r.Username, &AccessExpiration{
+			Username:  r.Username,
+			ExpiresAt: r.AccessExpiresAt,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, accessExpirationsKey))
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("Access of user %s scheduled to end at %s", r.Username, r.AccessExpiresAt))
 	}
 
 	// Call UpdateCRL to revoke all other certificates
-	_, err = UpdateCRL(
+	crl, err := UpdateCRL(ctx,
 		&UpdateCRLRequest{
 			Client:              r.Client,
 			VaultPKIPath:        r.VaultPKIPaths[len(r.VaultPKIPaths)-1],
+			VaultKVPath:         r.VaultKVPath,
 			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			MaxRevocations:      r.MaxRevocations,
 		}, logger)
 
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	issued := &IssueCertificateResponse{
+		Config:       config.String(),
+		SerialNumber: serial,
+		Revoked:      crl.Revoked,
+		Skipped:      crl.Skipped,
+	}
+	skipped := map[string]bool{}
+	for _, s := range crl.Skipped {
+		skipped[s] = true
+	}
+	for _, crt := range devices[device] {
+		if skipped[crt.SerialNumber] {
+			return issued, fmt.Errorf("certificate %s issued, but the previous certificates of the device are still valid: %w",
+				serial, crl.LimitError())
+		}
+	}
+	return issued, nil
+}
+
+// configKey returns the key in the kv store where the
+// VPN config of the given user and device is stored
+func configKey(username string, device string, cfgKey string) string {
+	if device == DefaultDevice {
+		return fmt.Sprintf("users/%s/%s", username, cfgKey)
 	}
+	return fmt.Sprintf("users/%s/devices/%s/%s", username, device, cfgKey)
+}
+
+// ErrConfigNotFound is returned when no VPN config
+// has been issued for the user and device
+var ErrConfigNotFound = errors.New("config not found")
+
+// GetClientConfigRequest is the structure containing the
+// required data to retrieve the VPN config of a user
+type GetClientConfigRequest struct {
+	Client           *api.Client
+	VaultKVPath      string
+	VaultKVConfigKey string
+	Username         string
+	Device           string
+}
 
-	return config.String(), nil
+type clientConfig struct {
+	Content string `json:"content"`
+}
+
+// GetClientConfig returns the last VPN config issued
+// for the given device of a user
+func GetClientConfig(ctx context.Context, r *GetClientConfigRequest, logger logr.Logger) (string, error) {
+	if err := validateUsername(r.Username); err != nil {
+		return "", err
+	}
+	if err := validateDeviceName(r.Device); err != nil {
+		return "", err
+	}
+	key := configKey(r.Username, deviceOrDefault(r.Device), r.VaultKVConfigKey)
+	cfg := clientConfig{}
+	found, err := readKVData(ctx, r.Client, r.VaultKVPath, key, &cfg)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to read %s/data/%s from KV2 store", r.VaultKVPath, key))
+		return "", err
+	}
+	if !found || cfg.Content == "" {
+		return "", fmt.Errorf("%w for user %s and device %s", ErrConfigNotFound, r.Username, deviceOrDefault(r.Device))
+	}
+	return cfg.Content, nil
 }
 
 // revokeUserCertificates receives a list of certificates, sorted from oldest to newest, and revokes
 // all but the latest if "revokeAll" is false and all of them if "revokeAll" is true.
-func revokeUserCertificates(client *api.Client, pki string, crts []Certificate, revokeAll bool, logger logr.Logger) error {
+// It returns the serial numbers of the revoked certificates.
+func revokeUserCertificates(ctx context.Context, client *api.Client, pki string, crts []Certificate, revokeAll bool, logger logr.Logger) ([]string, error) {
 
+	revoked := []string{}
 	for n, crt := range crts {
 		// Do not revoke the last certificate
 		if n == len(crts)-1 && !revokeAll {
 			break
 		}
 		if !crt.Revoked {
-			payload := make(map[string]interface{})
-			payload["serial_number"] = crt.SerialNumber
-			if _, err := client.Logical().Write(fmt.Sprintf("%s/revoke", pki), payload); err != nil {
-				logger.Error(err, fmt.Sprintf("unable to revoke certificate %s/%s", crt.SubjectCN, crt.SerialNumber))
-				return err
+			if err := revokeCertificate(ctx, client, pki, crt, logger); err != nil {
+				return revoked, err
 			}
-			logger.Info(fmt.Sprintf("Revoked cert %s/%s\n", crt.SubjectCN, crt.SerialNumber))
-
+			revoked = append(revoked, crt.SerialNumber)
 		}
 	}
 
+	return revoked, nil
+}
+
+// revokeCertificate revokes a single certificate in the PKI
+func revokeCertificate(ctx context.Context, client *api.Client, pki string, crt Certificate, logger logr.Logger) error {
+	payload := make(map[string]interface{})
+	payload["serial_number"] = crt.SerialNumber
+	if _, err := vaultWrite(ctx, client, fmt.Sprintf("%s/revoke", pki), payload); err != nil {
+		logger.Error(err, fmt.Sprintf("unable to revoke certificate %s/%s", crt.SubjectCN, crt.SerialNumber))
+		return err
+	}
+	logger.Info(fmt.Sprintf("Revoked cert %s/%s\n", crt.SubjectCN, crt.SerialNumber))
 	return nil
 }
+
+// planRevocations returns the certificates that need to be revoked to keep
+// just the latest certificate of each user and device active. The users'
+// certificates must be sorted from oldest to newest. Deferred certificates
+// are kept valid until their grace period ends.
+func planRevocations(users map[string][]Certificate, deferred map[string]bool) []Certificate {
+	usernames := make([]string, 0, len(users))
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	pending := []Certificate{}
+	for _, username := range usernames {
+		crts := users[username]
+		latest := map[string]string{}
+		for _, crt := range crts {
+			latest[crt.Device] = crt.SerialNumber
+		}
+		for _, crt := range crts {
+			if latest[crt.Device] != crt.SerialNumber && !crt.Revoked && !deferred[crt.SerialNumber] {
+				pending = append(pending, crt)
+			}
+		}
+	}
+	return pending
+}
+
+func serialNumbers(crts []Certificate) []string {
+	serials := make([]string, 0, len(crts))
+	for _, crt := range crts {
+		serials = append(serials, crt.SerialNumber)
+	}
+	return serials
+}
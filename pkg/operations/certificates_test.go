@@ -0,0 +1,109 @@
+package operations
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// TestIssueDefersRevocationsBeforeIssuing checks that the previous certificate
+// of the device is already deferred when the new one is issued, so a CRL update
+// running in between doesn't revoke it, and that the deferral is restored if
+// the issue fails.
+func TestIssueDefersRevocationsBeforeIssuing(t *testing.T) {
+	pki := newTestPKI(t)
+	kv := &fakeKV{secrets: map[string]map[string]any{}, versions: map[string]int{}}
+	ctx := context.Background()
+
+	old := &x509.Certificate{
+		SerialNumber: big.NewInt(0x1a2b),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, old, pki.ca, &pki.key.PublicKey, pki.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSerial := getHexFormatted(old.SerialNumber.Bytes())
+	crl := pki.crl(t, time.Now().Add(time.Hour))
+
+	// The users as seen by a CRL update that runs while the certificate is issued
+	var plannedDuringIssue []Certificate
+	var client *api.Client
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/secret/"):
+			kv.ServeHTTP(w, r)
+		case r.URL.Path == "/v1/pki-issue/crl/pem":
+			w.Write(crl)
+		case r.URL.Path == "/v1/pki-issue/certs":
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"keys": []string{oldSerial}}})
+		case r.URL.Path == "/v1/pki-issue/cert/"+oldSerial:
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+				"certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			}})
+		case r.URL.Path == "/v1/pki-issue/issue/client":
+			deferred, err := deferredSerials(context.Background(), client, "secret")
+			if err != nil {
+				t.Errorf("deferredSerials() error = %v", err)
+			}
+			newer := Certificate{SerialNumber: "ff-ff", Device: DefaultDevice, NotBefore: time.Now()}
+			oldCrt := Certificate{SerialNumber: oldSerial, Device: DefaultDevice, NotBefore: old.NotBefore}
+			plannedDuringIssue = planRevocations(map[string][]Certificate{"alice": {oldCrt, newer}}, deferred)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errors":["issue failed"]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	cfg.MaxRetries = 0
+	if client, err = api.NewClient(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// A previous issuance deferred the revocation of the certificate
+	previous := PendingRevocation{SerialNumber: "0c-0d", Username: "alice", Device: DefaultDevice, RevokeAt: time.Now().Add(time.Hour).UTC()}
+	if err := replacePendingRevocations(ctx, client, "secret", func(PendingRevocation) bool { return true }, []PendingRevocation{previous}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = IssueClientCertificate(ctx, &IssueCertificateRequest{
+		Client:        client,
+		VaultPKIPaths: []string{"pki-issue"},
+		Username:      "alice",
+		VaultPKIRole:  "client",
+		VaultKVPath:   "secret",
+		GracePeriod:   24 * time.Hour,
+	}, logr.Discard())
+	if err == nil {
+		t.Fatalf("IssueClientCertificate() error = nil, want the issue error")
+	}
+	if len(plannedDuringIssue) != 0 {
+		t.Errorf("CRL update during the issue would revoke %v, want the previous certificate deferred", serialNumbers(plannedDuringIssue))
+	}
+
+	revocations, err := getPendingRevocations(ctx, client, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revocations) != 1 || revocations[0].SerialNumber != previous.SerialNumber || !revocations[0].RevokeAt.Equal(previous.RevokeAt) {
+		t.Errorf("pending revocations after a failed issue = %+v, want %+v", revocations, previous)
+	}
+}
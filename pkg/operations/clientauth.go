@@ -0,0 +1,140 @@
+package operations
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// ErrUnrestrictedPKIRole is returned when the PKI role used for client
+// certificate auth does not set an OU or organization, so its certificates
+// can't be told apart from the ones issued by other roles of the same PKI
+var ErrUnrestrictedPKIRole = errors.New("PKI role does not set an OU or organization")
+
+// ClientAuthTrust holds the data required to authenticate callers
+// by the client certificates issued by a Vault PKI role
+type ClientAuthTrust struct {
+	// CA is the CA of the PKI that issues the certificates
+	CA *x509.Certificate
+	// OrganizationalUnits and Organizations are the subject
+	// fields the role sets in the certificates it issues
+	OrganizationalUnits []string
+	Organizations       []string
+	// Revoked holds the serial numbers, in decimal,
+	// of the certificates in the CRL of the PKI
+	Revoked   map[string]bool
+	FetchedAt time.Time
+}
+
+// Verify checks that the certificate chain has been issued by
+// the role and the leaf certificate has not been revoked
+func (t *ClientAuthTrust) Verify(chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return errors.New("no client certificate")
+	}
+	leaf := chain[0]
+
+	roots := x509.NewCertPool()
+	roots.AddCert(t.CA)
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return err
+	}
+
+	if !containsAll(leaf.Subject.OrganizationalUnit, t.OrganizationalUnits) ||
+		!containsAll(leaf.Subject.Organization, t.Organizations) {
+		return errors.New("client certificate has not been issued by the required PKI role")
+	}
+	if t.Revoked[leaf.SerialNumber.String()] {
+		return fmt.Errorf("client certificate %s has been revoked", leaf.SerialNumber)
+	}
+	return nil
+}
+
+// GetClientAuthTrustRequest is the structure containing the required
+// data to retrieve the trust data of a PKI role
+type GetClientAuthTrustRequest struct {
+	Client       *api.Client
+	VaultPKIPath string
+	VaultPKIRole string
+}
+
+// GetClientAuthTrust reads the CA, the CRL and the subject
+// fields of the certificates issued by the PKI role
+func GetClientAuthTrust(ctx context.Context, r *GetClientAuthTrustRequest, logger logr.Logger) (*ClientAuthTrust, error) {
+	path := fmt.Sprintf("%s/roles/%s", r.VaultPKIPath, r.VaultPKIRole)
+	role, err := vaultRead(ctx, r.Client, path)
+	if err != nil {
+		logger.Error(err, "unable to read "+path)
+		return nil, err
+	}
+	if role == nil {
+		return nil, fmt.Errorf("PKI role %s not found", path)
+	}
+	trust := &ClientAuthTrust{
+		OrganizationalUnits: stringsField(role.Data["ou"]),
+		Organizations:       stringsField(role.Data["organization"]),
+		Revoked:             map[string]bool{},
+		FetchedAt:           time.Now(),
+	}
+	if len(trust.OrganizationalUnits) == 0 && len(trust.Organizations) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnrestrictedPKIRole, path)
+	}
+
+	trust.CA, err = getCA(ctx, r.Client, r.VaultPKIPath)
+	if err != nil {
+		logger.Error(err, "unable to retrieve CA for "+r.VaultPKIPath)
+		return nil, err
+	}
+
+	crl, err := GetCRL(ctx, &GetCRLRequest{Client: r.Client, VaultPKIPath: r.VaultPKIPath}, logger)
+	if err != nil {
+		return nil, err
+	}
+	list, err := parseCRL(crl)
+	if err != nil {
+		logger.Error(err, "unable to parse CRL")
+		return nil, err
+	}
+	for _, entry := range list.RevokedCertificateEntries {
+		trust.Revoked[entry.SerialNumber.String()] = true
+	}
+
+	return trust, nil
+}
+
+// stringsField returns the strings of a list field of a Vault response
+func stringsField(v any) []string {
+	values := []string{}
+	list, _ := v.([]any)
+	for _, e := range list {
+		if s, ok := e.(string); ok && s != "" {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// containsAll returns true if all the wanted values are in the list
+func containsAll(list []string, wanted []string) bool {
+	for _, w := range wanted {
+		if !slices.Contains(list, w) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/metrics"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/tracing"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/go-logr/logr"
+)
+
+// awsTimeLayout is the format used by the Client VPN API
+// for the connection timestamps
+const awsTimeLayout = "2006-01-02 15:04:05"
+
+// awsAPIOptions are added to the config of all the AWS clients
+var awsAPIOptions = []func(*middleware.Stack) error{metrics.InstrumentAWS, tracing.InstrumentAWS}
+
+// describeConnections returns all the client connections that the AWS
+// Client VPN endpoint reports, both active and already terminated ones
+func describeConnections(ctx context.Context, svc *ec2.Client, endpointID string) ([]Connection, error) {
+	conns := []Connection{}
+
+	paginator := ec2.NewDescribeClientVpnConnectionsPaginator(svc,
+		&ec2.DescribeClientVpnConnectionsInput{ClientVpnEndpointId: aws.String(endpointID)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page.Connections {
+			conns = append(conns, newConnection(c))
+		}
+	}
+
+	return conns, nil
+}
+
+func newConnection(c types.ClientVpnConnection) Connection {
+	conn := Connection{
+		ConnectionID: aws.ToString(c.ConnectionId),
+		CommonName:   aws.ToString(c.CommonName),
+		ClientIP:     aws.ToString(c.ClientIp),
+	}
+	if c.Status != nil {
+		conn.Status = string(c.Status.Code)
+	}
+	if t, err := time.Parse(awsTimeLayout, aws.ToString(c.ConnectionEstablishedTime)); err == nil {
+		conn.EstablishedTime = t
+	}
+	if t, err := time.Parse(awsTimeLayout, aws.ToString(c.ConnectionEndTime)); err == nil {
+		conn.EndTime = t
+	}
+	if n, err := strconv.ParseInt(aws.ToString(c.IngressBytes), 10, 64); err == nil {
+		conn.IngressBytes = n
+	}
+	if n, err := strconv.ParseInt(aws.ToString(c.EgressBytes), 10, 64); err == nil {
+		conn.EgressBytes = n
+	}
+	return conn
+}
+
+// terminateConnections terminates all the active connections to the AWS Client
+// VPN endpoint that match the given function. It returns the list of connections
+// that have been terminated.
+func terminateConnections(ctx context.Context, endpointID string, match func(Connection) bool, logger logr.Logger) ([]Connection, error) {
+	terminated := []Connection{}
+
+	ctx, cancel := context.WithTimeout(ctx, config.AwsApiTimeout)
+	defer cancel()
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithAPIOptions(awsAPIOptions))
+	if err != nil {
+		logger.Error(err, "unable to load AWS EC2 client")
+		return nil, err
+	}
+	svc := ec2.NewFromConfig(cfg)
+
+	conns, err := describeConnections(ctx, svc, endpointID)
+	if err != nil {
+		logger.Error(err, "error in AWS call to describeClientVpnConnections")
+		return nil, err
+	}
+
+	for _, conn := range conns {
+		if conn.Status != string(types.ClientVpnConnectionStatusCodeActive) || !match(conn) {
+			continue
+		}
+		_, err := svc.TerminateClientVpnConnections(ctx,
+			&ec2.TerminateClientVpnConnectionsInput{
+				ClientVpnEndpointId: aws.String(endpointID),
+				ConnectionId:        aws.String(conn.ConnectionID),
+			})
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("error in AWS call to terminateClientVpnConnections for connection %s", conn.ConnectionID))
+			return nil, err
+		}
+		logger.Info(fmt.Sprintf("Terminated connection %s/%s", conn.CommonName, conn.ConnectionID))
+		terminated = append(terminated, conn)
+	}
+
+	return terminated, nil
+}
@@ -0,0 +1,139 @@
+package operations
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-logr/logr"
+)
+
+// The coordinator serializes the operations of this process that change
+// the PKI. The changes to the certificates of each user are serialized
+// with a lock per user, so concurrent issues or revocations for the same
+// user don't revoke each other's certificates, and the CRL syncs run one
+// at a time, so an older CRL never overwrites a newer one in the endpoint.
+// The secrets shared in the kv store are updated with updateKVData.
+var (
+	userLocks = &keyedLocks{locks: map[string]*keyedLock{}}
+	crlSyncs  = &crlSyncer{pending: map[crlSyncKey]*crlSyncCall{}}
+)
+
+// keyedLocks is a set of locks identified by a key. Locks
+// are created on demand and removed once nobody holds them.
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// lock blocks until the lock of the key is acquired or ctx is
+// done. The returned function releases the lock.
+func (kl *keyedLocks) lock(ctx context.Context, key string) (func(), error) {
+	kl.mu.Lock()
+	l, ok := kl.locks[key]
+	if !ok {
+		l = &keyedLock{ch: make(chan struct{}, 1)}
+		kl.locks[key] = l
+	}
+	l.refs++
+	kl.mu.Unlock()
+
+	release := func() {
+		kl.mu.Lock()
+		defer kl.mu.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(kl.locks, key)
+		}
+	}
+
+	select {
+	case l.ch <- struct{}{}:
+		return func() {
+			<-l.ch
+			release()
+		}, nil
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// lockUser serializes the changes to the certificates of the user
+func lockUser(ctx context.Context, username string) (func(), error) {
+	return userLocks.lock(ctx, username)
+}
+
+// crlSyncKey are the parameters of a CRL sync. Only
+// syncs with the same parameters are coalesced.
+type crlSyncKey struct {
+	VaultPKIPath        string
+	VaultKVPath         string
+	ClientVPNEndpointID string
+	MaxRevocations      int
+	Override            bool
+}
+
+// crlSyncCall is a CRL sync shared by all the requests it absorbed
+type crlSyncCall struct {
+	done chan struct{}
+	rsp  *UpdateCRLResponse
+	err  error
+}
+
+// crlSyncer runs the CRL syncs one at a time. A sync requested while
+// another one is running waits for it to finish, as it might not include
+// the latest changes, and all the requests that arrive while it waits
+// are absorbed by it instead of running once each.
+type crlSyncer struct {
+	// running is held while a sync runs
+	running sync.Mutex
+	mu      sync.Mutex
+	// pending are the syncs waiting for the running one to finish
+	pending map[crlSyncKey]*crlSyncCall
+}
+
+// sync runs a CRL sync that starts after this call, or
+// joins the pending one, and returns the result of it
+func (cs *crlSyncer) sync(ctx context.Context, r *UpdateCRLRequest, logger logr.Logger) (*UpdateCRLResponse, error) {
+	key := crlSyncKey{
+		VaultPKIPath:        r.VaultPKIPath,
+		VaultKVPath:         r.VaultKVPath,
+		ClientVPNEndpointID: r.ClientVPNEndpointID,
+		MaxRevocations:      r.MaxRevocations,
+		Override:            r.Override,
+	}
+
+	cs.mu.Lock()
+	call, joined := cs.pending[key]
+	if !joined {
+		call = &crlSyncCall{done: make(chan struct{})}
+		cs.pending[key] = call
+	}
+	cs.mu.Unlock()
+
+	if joined {
+		logger.V(1).Info("CRL sync absorbed by a pending one")
+		select {
+		case <-call.done:
+			return call.rsp, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// The sync is shared with the requests that join it,
+	// so it is not cancelled if this one goes away
+	cs.running.Lock()
+	cs.mu.Lock()
+	delete(cs.pending, key)
+	cs.mu.Unlock()
+	call.rsp, call.err = updateCRL(context.WithoutCancel(ctx), r, logger)
+	cs.running.Unlock()
+	close(call.done)
+	return call.rsp, call.err
+}
@@ -0,0 +1,129 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	"github.com/hashicorp/vault/api"
+)
+
+func TestKeyedLocks(t *testing.T) {
+	kl := &keyedLocks{locks: map[string]*keyedLock{}}
+	ctx := context.Background()
+
+	unlock, err := kl.lock(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other keys are not blocked
+	unlockBob, err := kl.lock(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockBob()
+
+	// The same key is blocked until released or the context is done
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := kl.lock(timeout, "alice"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lock() error = %v, want context.DeadlineExceeded", err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		unlock, err := kl.lock(ctx, "alice")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- unlock
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired while held")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	(<-acquired)()
+
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	if len(kl.locks) != 0 {
+		t.Errorf("%d locks left after being released", len(kl.locks))
+	}
+}
+
+func TestCRLSyncerCoalescesPendingSyncs(t *testing.T) {
+	// Vault fails every request, so each sync
+	// fails as soon as it reaches Vault
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	cfg.MaxRetries = 0
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var absorbed atomic.Int64
+	logger := funcr.New(func(prefix, args string) {
+		if strings.Contains(args, "absorbed") {
+			absorbed.Add(1)
+		}
+	}, funcr.Options{Verbosity: 1})
+
+	cs := &crlSyncer{pending: map[crlSyncKey]*crlSyncCall{}}
+	r := &UpdateCRLRequest{Client: client, VaultPKIPath: "pki", ClientVPNEndpointID: "cvpn-endpoint"}
+	ctx := context.Background()
+
+	if _, err := cs.sync(ctx, r, logr.Discard()); err == nil {
+		t.Fatal("sync() = nil, want the error from Vault")
+	}
+	perSync := requests.Load()
+
+	// While a sync runs, the requested ones wait for it and are coalesced
+	cs.running.Lock()
+	errs := make(chan error, 3)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cs.sync(ctx, r, logger)
+			errs <- err
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for absorbed.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d syncs absorbed, want 2", absorbed.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cs.running.Unlock()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err == nil {
+			t.Error("sync() = nil, want the error of the shared sync")
+		}
+	}
+	if got := requests.Load() - perSync; got != perSync {
+		t.Errorf("coalesced syncs made %d requests to Vault, want the %d of a single sync", got, perSync)
+	}
+}
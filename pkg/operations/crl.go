@@ -2,11 +2,16 @@ package operations
 
 import (
 	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
-	"io"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/metrics"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
@@ -14,6 +19,10 @@ import (
 	"github.com/hashicorp/vault/api"
 )
 
+// ErrUnsafeCRL is returned when a CRL does not pass the
+// checks required to import it into the Client VPN endpoint
+var ErrUnsafeCRL = errors.New("refusing to import CRL into the Client VPN endpoint")
+
 // GetCRLRequest is the structure containing
 // the required data to issue a new certificate
 type GetCRLRequest struct {
@@ -22,38 +31,115 @@ type GetCRLRequest struct {
 }
 
 // GetCRL return the Client Revocation List PEM as a []byte
-func GetCRL(r *GetCRLRequest, logger logr.Logger) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), config.VaultApiTimeout)
-	defer cancel()
-	rsp, err := r.Client.Logical().ReadRawWithContext(ctx, fmt.Sprintf("/%s/crl/pem", r.VaultPKIPath))
+func GetCRL(ctx context.Context, r *GetCRLRequest, logger logr.Logger) ([]byte, error) {
+	data, err := vaultReadRaw(ctx, r.Client, fmt.Sprintf("/%s/crl/pem", r.VaultPKIPath))
 	if err != nil {
 		logger.Error(err, fmt.Sprintf("unable to retrieve CRL from Vault at path /%s/crl/pem", r.VaultPKIPath))
 		return nil, err
 	}
-	defer rsp.Body.Close()
-	data, err := io.ReadAll(rsp.Body)
-	if err != nil {
-		logger.Error(err, fmt.Sprintf("unable to read response body in call to /v1/%s/crl/pem", r.VaultPKIPath))
-	}
 
 	return data, nil
 }
 
+// ErrRevocationLimitExceeded is returned when a CRL update would
+// revoke more certificates than allowed in a single run
+var ErrRevocationLimitExceeded = errors.New("revocation limit exceeded")
+
+// RevocationLimitError is returned by the operations whose CRL update
+// skipped the revocation of older certificates because of the revocation
+// limit. The CRL was still imported into the Client VPN endpoint.
+type RevocationLimitError struct {
+	// Skipped are the serial numbers of the certificates not revoked
+	Skipped []string
+}
+
+func (e *RevocationLimitError) Error() string {
+	return fmt.Sprintf("%s: the CRL was updated, but %d older certificates were not revoked",
+		ErrRevocationLimitExceeded, len(e.Skipped))
+}
+
+func (e *RevocationLimitError) Unwrap() error {
+	return ErrRevocationLimitExceeded
+}
+
 // UpdateCRLRequest is the structure containing
 // the required data to issue a new certificate
 type UpdateCRLRequest struct {
-	Client              *api.Client
-	VaultPKIPath        string
+	Client       *api.Client
+	VaultPKIPath string
+	// VaultKVPath is where the pending revocations are read
+	// from. If empty, grace periods are not honored.
+	VaultKVPath         string
 	ClientVPNEndpointID string
+	// MaxRevocations is the maximum number of older certificates that
+	// can be revoked in a single run. If exceeded, none of them is revoked,
+	// but the CRL is still updated. Zero means no limit.
+	MaxRevocations int
+	// Override allows the run to exceed MaxRevocations
+	Override bool
+}
+
+// PreviewUpdateCRL returns the certificates that would
+// be revoked by UpdateCRL, without revoking anything
+func PreviewUpdateCRL(ctx context.Context, r *UpdateCRLRequest, logger logr.Logger) ([]Certificate, error) {
+
+	// Get the list of users
+	users, err := ListUsers(ctx,
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+		}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	deferred, err := deferredSerials(ctx, r.Client, r.VaultKVPath)
+	if err != nil {
+		logger.Error(err, "unable to retrieve the pending revocations")
+		return nil, err
+	}
+
+	return planRevocations(users, deferred), nil
+}
+
+// UpdateCRLResponse is the structure containing
+// the result of a CRL update
+type UpdateCRLResponse struct {
+	CRL []byte
+	// Revoked are the serial numbers of the certificates
+	// revoked by the update
+	Revoked []string
+	// Skipped are the serial numbers of the older certificates that
+	// were not revoked because they exceeded the revocation limit
+	Skipped []string
+}
+
+// LimitError returns a RevocationLimitError if the update
+// skipped certificates because of the revocation limit
+func (r *UpdateCRLResponse) LimitError() error {
+	if len(r.Skipped) == 0 {
+		return nil
+	}
+	return &RevocationLimitError{Skipped: r.Skipped}
 }
 
 // UpdateCRL maintains the CRL to keep just one active certificte per
 // VPN user. This will always be the one emitted at a later date. Users
 // can also have all their certificates revoked.
-func UpdateCRL(r *UpdateCRLRequest, logger logr.Logger) ([]byte, error) {
+// Updates run one at a time, and the ones requested while another is
+// running are coalesced, so Revoked might include certificates revoked
+// on behalf of other callers.
+func UpdateCRL(ctx context.Context, r *UpdateCRLRequest, logger logr.Logger) (*UpdateCRLResponse, error) {
+	return crlSyncs.sync(ctx, r, logger)
+}
+
+// updateCRL performs the CRL update. Use UpdateCRL, which
+// serializes the updates.
+func updateCRL(ctx context.Context, r *UpdateCRLRequest, logger logr.Logger) (*UpdateCRLResponse, error) {
 
 	// Get the list of users
-	users, err := ListUsers(
+	users, err := ListUsers(ctx,
 		&ListUsersRequest{
 			Client:              r.Client,
 			VaultPKIPath:        r.VaultPKIPath,
@@ -63,16 +149,42 @@ func UpdateCRL(r *UpdateCRLRequest, logger logr.Logger) ([]byte, error) {
 		return nil, err
 	}
 
-	//For each user, get the list of certificates, and revoke all of them but the latest
-	for _, crts := range users {
-		err := revokeUserCertificates(r.Client, r.VaultPKIPath, crts, false, logger)
-		if err != nil {
+	// For each user, get the list of certificates, and revoke all of them but the latest.
+	// A bug or an unexpected list of users could cause the revocation of many valid
+	// certificates at once, so they are skipped if they exceed the limit. The CRL is
+	// imported anyway, so it never expires in the endpoint and the certificates revoked
+	// explicitly, which are already in it, are always enforced.
+	deferred, err := deferredSerials(ctx, r.Client, r.VaultKVPath)
+	if err != nil {
+		logger.Error(err, "unable to retrieve the pending revocations")
+		return nil, err
+	}
+	pending := planRevocations(users, deferred)
+	rsp := &UpdateCRLResponse{}
+	if r.MaxRevocations > 0 && len(pending) > r.MaxRevocations {
+		limitLogger := logger.WithValues("serials", serialNumbers(pending), "limit", r.MaxRevocations)
+		if !r.Override {
+			limitLogger.Info("Revocation limit exceeded, older certificates not revoked")
+			rsp.Skipped = serialNumbers(pending)
+			pending = nil
+		} else {
+			limitLogger.Info("Revocation limit overridden")
+		}
+	}
+
+	// Once certificates start being revoked the CRL has to reach the
+	// endpoint, so the update is not cancelled from here on. Each call
+	// is still bounded by its own timeout.
+	ctx = context.WithoutCancel(ctx)
+	for _, crt := range pending {
+		if err := revokeCertificate(ctx, r.Client, r.VaultPKIPath, crt, logger); err != nil {
 			return nil, err
 		}
 	}
+	rsp.Revoked = serialNumbers(pending)
 
 	// Get the updated CRL
-	crl, err := GetCRL(
+	crl, err := GetCRL(ctx,
 		&GetCRLRequest{
 			Client:       r.Client,
 			VaultPKIPath: r.VaultPKIPath,
@@ -82,9 +194,9 @@ func UpdateCRL(r *UpdateCRLRequest, logger logr.Logger) ([]byte, error) {
 	}
 
 	// Upload new CRL to AWS Client VPN endpoint
-	ctx1, cancel1 := context.WithTimeout(context.Background(), config.AwsApiTimeout)
+	ctx1, cancel1 := context.WithTimeout(ctx, config.AwsApiTimeout)
 	defer cancel1()
-	cfg, err := awsconfig.LoadDefaultConfig(ctx1)
+	cfg, err := awsconfig.LoadDefaultConfig(ctx1, awsconfig.WithAPIOptions(awsAPIOptions))
 	if err != nil {
 		logger.Error(err, "unable to load AWS EC2 client")
 		return nil, err
@@ -100,7 +212,7 @@ func UpdateCRL(r *UpdateCRLRequest, logger logr.Logger) ([]byte, error) {
 	}
 
 	//reset the timeout
-	ctx2, cancel2 := context.WithTimeout(context.Background(), config.AwsApiTimeout)
+	ctx2, cancel2 := context.WithTimeout(ctx, config.AwsApiTimeout)
 	defer cancel2()
 
 	// Handle the case that no CRL has been uploaded yet. The API
@@ -110,6 +222,11 @@ func UpdateCRL(r *UpdateCRLRequest, logger logr.Logger) ([]byte, error) {
 	if reflect.ValueOf(*cvpnCRL).FieldByName("CertificateRevocationList").Elem().IsValid() {
 		if *cvpnCRL.CertificateRevocationList != string(crl) {
 			// CRL needs update
+			err = checkCRL(ctx, r.Client, r.VaultPKIPath, crl, []byte(*cvpnCRL.CertificateRevocationList), users)
+			if err != nil {
+				logger.Error(err, "CRL failed the safety checks")
+				return nil, err
+			}
 			_, err = svc.ImportClientVpnClientCertificateRevocationList(ctx2,
 				&ec2.ImportClientVpnClientCertificateRevocationListInput{
 					CertificateRevocationList: aws.String(string(crl)),
@@ -125,6 +242,11 @@ func UpdateCRL(r *UpdateCRLRequest, logger logr.Logger) ([]byte, error) {
 		}
 	} else {
 		// CRL first time import
+		err = checkCRL(ctx, r.Client, r.VaultPKIPath, crl, nil, users)
+		if err != nil {
+			logger.Error(err, "CRL failed the safety checks")
+			return nil, err
+		}
 		_, err = svc.ImportClientVpnClientCertificateRevocationList(ctx2,
 			&ec2.ImportClientVpnClientCertificateRevocationListInput{
 				CertificateRevocationList: aws.String(string(crl)),
@@ -137,7 +259,83 @@ func UpdateCRL(r *UpdateCRLRequest, logger logr.Logger) ([]byte, error) {
 		logger.Info("First upload of the CRL to the Client VPN endpoint")
 	}
 
-	return crl, nil
+	rsp.CRL = crl
+	return rsp, nil
+}
+
+// checkCRL verifies that a CRL is safe to be imported into the AWS Client VPN endpoint. A bad
+// CRL can either lock out every user or silently unrevoke certificates, so the CRL must:
+//   - parse cleanly
+//   - be signed by the CA of the PKI
+//   - have its NextUpdate in the future
+//   - not exceed the maximum number of entries supported by AWS
+//   - not drop entries of revoked certificates that are still valid, compared to the
+//     CRL currently imported in the endpoint. Entries of certificates that have expired
+//     or have been tidied from the PKI can be safely dropped.
+func checkCRL(ctx context.Context, client *api.Client, pki string, crlPEM []byte, previousPEM []byte, users map[string][]Certificate) error {
+	list, err := parseCRL(crlPEM)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnsafeCRL, err)
+	}
+
+	ca, err := getCA(ctx, client, pki)
+	if err != nil {
+		return err
+	}
+	if err := list.CheckSignatureFrom(ca); err != nil {
+		return fmt.Errorf("%w: signature does not verify against the CA in %s: %w", ErrUnsafeCRL, pki, err)
+	}
+
+	if !list.NextUpdate.After(time.Now()) {
+		return fmt.Errorf("%w: NextUpdate %s is in the past", ErrUnsafeCRL, list.NextUpdate)
+	}
+
+	if len(list.RevokedCertificateEntries) > config.AwsMaxCRLEntries {
+		return fmt.Errorf("%w: %d entries exceed the AWS limit of %d",
+			ErrUnsafeCRL, len(list.RevokedCertificateEntries), config.AwsMaxCRLEntries)
+	}
+
+	if previousPEM == nil {
+		return nil
+	}
+	previous, err := parseCRL(previousPEM)
+	if err != nil {
+		// The CRL in the endpoint can't be compared, but that
+		// should not prevent replacing it with a valid one
+		return nil
+	}
+
+	entries := crlSerials(list)
+	valid := map[string]Certificate{}
+	now := time.Now()
+	for _, crts := range users {
+		for _, crt := range crts {
+			if now.Before(crt.NotAfter) {
+				valid[crt.SerialNumber] = crt
+			}
+		}
+	}
+	for _, entry := range previous.RevokedCertificateEntries {
+		serial := strings.TrimSpace(getHexFormatted(entry.SerialNumber.Bytes()))
+		if crt, ok := valid[serial]; ok && !entries[serial] {
+			return fmt.Errorf("%w: certificate %s/%s would be unrevoked", ErrUnsafeCRL, crt.SubjectCN, serial)
+		}
+	}
+
+	return nil
+}
+
+// getCA retrieves and parses the CA certificate of a PKI
+func getCA(ctx context.Context, client *api.Client, pki string) (*x509.Certificate, error) {
+	data, err := vaultReadRaw(ctx, client, fmt.Sprintf("/%s/ca/pem", pki))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("unable to decode PEM encoded CA from /%s/ca/pem", pki)
+	}
+	return x509.ParseCertificate(block.Bytes)
 }
 
 // RotateCRLRequest is the structure containing the
@@ -145,28 +343,112 @@ func UpdateCRL(r *UpdateCRLRequest, logger logr.Logger) ([]byte, error) {
 type RotateCRLRequest struct {
 	Client              *api.Client
 	VaultPKIPath        string
+	VaultKVPath         string
 	ClientVPNEndpointID string
+	MaxRevocations      int
+	Override            bool
 }
 
-func RotateCRL(r *RotateCRLRequest, logger logr.Logger) ([]byte, error) {
+func RotateCRL(ctx context.Context, r *RotateCRLRequest, logger logr.Logger) (*UpdateCRLResponse, error) {
 
-	ctx, cancel := context.WithTimeout(context.Background(), config.VaultApiTimeout)
-	defer cancel()
-	_, err := r.Client.Logical().ReadRawWithContext(ctx, fmt.Sprintf("/%s/crl/rotate", r.VaultPKIPath))
+	_, err := vaultReadRaw(ctx, r.Client, fmt.Sprintf("/%s/crl/rotate", r.VaultPKIPath))
 	if err != nil {
 		logger.Error(err, fmt.Sprintf("error in Vault call to /%s/crl/rotate", r.VaultPKIPath))
 		return nil, err
 	}
 
-	crl, err := UpdateCRL(
+	rsp, err := UpdateCRL(ctx,
 		&UpdateCRLRequest{
 			Client:              r.Client,
 			VaultPKIPath:        r.VaultPKIPath,
+			VaultKVPath:         r.VaultKVPath,
 			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			MaxRevocations:      r.MaxRevocations,
+			Override:            r.Override,
+		}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp, nil
+}
+
+// GetCRLStatusRequest is the structure containing the
+// required data to retrieve the status of the CRLs
+type GetCRLStatusRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	ClientVPNEndpointID string
+}
+
+// GetCRLStatus parses both the CRL in Vault and the one exported from the AWS Client VPN
+// endpoint and returns their validity. AWS rejects every connection once the CRL
+// imported in the endpoint has passed its NextUpdate.
+func GetCRLStatus(ctx context.Context, r *GetCRLStatusRequest, logger logr.Logger) (*CRLStatus, error) {
+	status := &CRLStatus{}
+	now := time.Now()
+
+	crl, err := GetCRL(ctx,
+		&GetCRLRequest{
+			Client:       r.Client,
+			VaultPKIPath: r.VaultPKIPath,
 		}, logger)
 	if err != nil {
 		return nil, err
 	}
+	list, err := parseCRL(crl)
+	if err != nil {
+		logger.Error(err, "unable to parse the Vault CRL")
+		return nil, err
+	}
+	status.Vault = newCRLInfo(list, now)
+
+	ctx, cancel := context.WithTimeout(ctx, config.AwsApiTimeout)
+	defer cancel()
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithAPIOptions(awsAPIOptions))
+	if err != nil {
+		logger.Error(err, "unable to load AWS EC2 client")
+		return nil, err
+	}
+	svc := ec2.NewFromConfig(cfg)
+	cvpnCRL, err := svc.ExportClientVpnClientCertificateRevocationList(ctx,
+		&ec2.ExportClientVpnClientCertificateRevocationListInput{
+			ClientVpnEndpointId: &r.ClientVPNEndpointID,
+		})
+	if err != nil {
+		logger.Error(err, "error in AWS call exportClientVpnClientCertificateRevocationList")
+		return nil, err
+	}
+
+	// The endpoint might not have a CRL imported yet
+	if cvpnCRL.CertificateRevocationList != nil {
+		list, err := parseCRL([]byte(*cvpnCRL.CertificateRevocationList))
+		if err != nil {
+			logger.Error(err, "unable to parse the Client VPN endpoint CRL")
+			return nil, err
+		}
+		status.Endpoint = newCRLInfo(list, now)
+		metrics.CRLNextUpdate.WithLabelValues("endpoint").Set(float64(list.NextUpdate.Unix()))
+	}
+	metrics.CRLNextUpdate.WithLabelValues("vault").Set(float64(status.Vault.NextUpdate.Unix()))
+
+	return status, nil
+}
+
+func newCRLInfo(list *x509.RevocationList, now time.Time) *CRLInfo {
+	return &CRLInfo{
+		ThisUpdate: list.ThisUpdate,
+		NextUpdate: list.NextUpdate,
+		Remaining:  list.NextUpdate.Sub(now).Round(time.Second).String(),
+		Entries:    len(list.RevokedCertificateEntries),
+	}
+}
 
-	return crl, nil
+// parseCRL decodes and parses a PEM encoded CRL
+func parseCRL(crlPEM []byte) (*x509.RevocationList, error) {
+	block, _ := pem.Decode(crlPEM)
+	if block == nil || block.Type != "X509 CRL" {
+		return nil, errors.New("unable to decode PEM encoded CRL")
+	}
+	return x509.ParseRevocationList(block.Bytes)
 }
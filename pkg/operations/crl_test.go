@@ -0,0 +1,173 @@
+package operations
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestPlanRevocations(t *testing.T) {
+	users := map[string][]Certificate{
+		"bob": {
+			{SerialNumber: "b1", Device: ""},
+			{SerialNumber: "b2", Device: ""},
+		},
+		"alice": {
+			{SerialNumber: "a1", Device: "laptop"},
+			{SerialNumber: "a2", Device: "phone"},
+			{SerialNumber: "a3", Device: "laptop", Revoked: true},
+			{SerialNumber: "a4", Device: "laptop"},
+			{SerialNumber: "a5", Device: "phone"},
+		},
+	}
+
+	got := serialNumbers(planRevocations(users, map[string]bool{"a2": true}))
+	// The newest certificate of each device is kept, the revoked and
+	// the deferred ones are skipped, and users are sorted by name
+	want := []string{"a1", "b1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("planRevocations() = %v, want %v", got, want)
+	}
+}
+
+func TestUpdateCRLResponseLimitError(t *testing.T) {
+	if err := (&UpdateCRLResponse{Revoked: []string{"a1"}}).LimitError(); err != nil {
+		t.Errorf("LimitError() = %v, want nil", err)
+	}
+	err := (&UpdateCRLResponse{Skipped: []string{"a1", "b1"}}).LimitError()
+	if !errors.Is(err, ErrRevocationLimitExceeded) {
+		t.Errorf("LimitError() = %v, want ErrRevocationLimitExceeded", err)
+	}
+	// The skipped serials are still available when the error is wrapped
+	var rle *RevocationLimitError
+	if !errors.As(fmt.Errorf("issue: %w", err), &rle) || !reflect.DeepEqual(rle.Skipped, []string{"a1", "b1"}) {
+		t.Errorf("LimitError() = %v, want a RevocationLimitError with the skipped serials", err)
+	}
+}
+
+// testPKI is a CA that signs CRLs, served like a Vault PKI
+type testPKI struct {
+	key    *ecdsa.PrivateKey
+	ca     *x509.Certificate
+	client *api.Client
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/pki/ca/pem" {
+			http.NotFound(w, r)
+			return
+		}
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}))
+	t.Cleanup(srv.Close)
+
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testPKI{key: key, ca: ca, client: client}
+}
+
+// crl returns a CRL signed by the CA that revokes the given serials
+func (p *testPKI) crl(t *testing.T, nextUpdate time.Time, serials ...int64) []byte {
+	t.Helper()
+	entries := []x509.RevocationListEntry{}
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, p.ca, p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestCheckCRL(t *testing.T) {
+	pki := newTestPKI(t)
+	other := newTestPKI(t)
+	ctx := context.Background()
+	serial := func(n int64) string { return getHexFormatted(big.NewInt(n).Bytes()) }
+	users := map[string][]Certificate{
+		"alice": {
+			{SerialNumber: serial(16), SubjectCN: "alice", NotAfter: time.Now().Add(time.Hour)},
+			{SerialNumber: serial(17), SubjectCN: "alice", NotAfter: time.Now().Add(-time.Hour)},
+		},
+	}
+	next := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		crl      []byte
+		previous []byte
+		wantErr  string
+	}{
+		{name: "valid", crl: pki.crl(t, next, 16)},
+		{name: "valid without previous CRL", crl: pki.crl(t, next), previous: nil},
+		{name: "keeps revocations", crl: pki.crl(t, next, 16), previous: pki.crl(t, next, 16)},
+		{name: "drops expired revocations", crl: pki.crl(t, next), previous: pki.crl(t, next, 17)},
+		{name: "not a CRL", crl: []byte("garbage"), wantErr: "unable to decode"},
+		{name: "wrong signer", crl: other.crl(t, next), wantErr: "signature does not verify"},
+		{name: "expired", crl: pki.crl(t, time.Now().Add(-time.Second)), wantErr: "is in the past"},
+		{name: "unrevokes a valid certificate", crl: pki.crl(t, next), previous: pki.crl(t, next, 16), wantErr: "would be unrevoked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCRL(ctx, pki.client, "pki", tt.crl, tt.previous, users)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkCRL() = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrUnsafeCRL) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkCRL() = %v, want ErrUnsafeCRL with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
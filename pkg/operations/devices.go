@@ -0,0 +1,195 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// DefaultDevice is the device of the certificates whose common
+// name is just the username, without a "@<device>" suffix
+const DefaultDevice = "default"
+
+var (
+	// ErrInvalidDeviceName is returned when the name of a device
+	// can't be used as part of a certificate common name
+	ErrInvalidDeviceName = errors.New("invalid device name")
+	// ErrDeviceQuotaExceeded is returned when issuing a certificate for a new
+	// device would exceed the maximum number of devices allowed per user
+	ErrDeviceQuotaExceeded = errors.New("device quota exceeded")
+
+	deviceNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+)
+
+// parseCommonName splits a certificate common name in the
+// username and the device the certificate was issued for
+func parseCommonName(cn string) (string, string) {
+	username, device, found := strings.Cut(cn, "@")
+	if !found || device == "" {
+		return username, DefaultDevice
+	}
+	return username, device
+}
+
+// commonName returns the certificate common name for
+// the given username and device
+func commonName(username string, device string) string {
+	if device == "" || device == DefaultDevice {
+		return username
+	}
+	return username + "@" + device
+}
+
+// deviceOrDefault returns the default device
+// when no device is given
+func deviceOrDefault(device string) string {
+	if device == "" {
+		return DefaultDevice
+	}
+	return device
+}
+
+// validateDeviceName checks that the device name can be used
+// as part of a certificate common name
+func validateDeviceName(device string) error {
+	if device != "" && !deviceNameRegexp.MatchString(device) {
+		return fmt.Errorf("%w '%s': only letters, numbers, '.', '_' and '-' are allowed", ErrInvalidDeviceName, device)
+	}
+	return nil
+}
+
+// activeDevices returns the devices that have at least
+// one active certificate
+func activeDevices(crts []Certificate) map[string][]Certificate {
+	devices := map[string][]Certificate{}
+	now := time.Now()
+	for _, crt := range crts {
+		if !crt.Revoked && now.Before(crt.NotAfter) {
+			devices[crt.Device] = append(devices[crt.Device], crt)
+		}
+	}
+	return devices
+}
+
+// ListUserDevicesRequest is the structure containing
+// the required data to list the devices of a user
+type ListUserDevicesRequest struct {
+	Client       *api.Client
+	VaultPKIPath string
+	Username     string
+}
+
+// ListUserDevices returns the certificates of a user grouped by device
+func ListUserDevices(ctx context.Context, r *ListUserDevicesRequest, logger logr.Logger) (map[string][]Certificate, error) {
+	users, err := ListUsers(ctx,
+		&ListUsersRequest{
+			Client:       r.Client,
+			VaultPKIPath: r.VaultPKIPath,
+		}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := map[string][]Certificate{}
+	for _, crt := range users[r.Username] {
+		devices[crt.Device] = append(devices[crt.Device], crt)
+	}
+	return devices, nil
+}
+
+// RevokeDeviceRequest is the structure containing
+// the required data to revoke a device of a user
+type RevokeDeviceRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	VaultKVPath         string
+	Username            string
+	Device              string
+	ClientVPNEndpointID string
+	MaxRevocations      int
+}
+
+// RevokeDevice revokes all the issued certificates for a given device of a user and
+// terminates any active session established from that device. The certificates
+// of the other devices of the user are not affected. The response is also returned
+// with a RevocationLimitError if the CRL update skipped older certificates.
+func RevokeDevice(ctx context.Context, r *RevokeDeviceRequest, logger logr.Logger) (*RevokeUserResponse, error) {
+	if err := validateUsername(r.Username); err != nil {
+		return nil, err
+	}
+	if err := validateDeviceName(r.Device); err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockUser(ctx, r.Username)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	users, err := ListUsers(ctx,
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+		}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	device := deviceOrDefault(r.Device)
+	crts := []Certificate{}
+	for _, crt := range users[r.Username] {
+		if crt.Device == device {
+			crts = append(crts, crt)
+		}
+	}
+
+	// The CRL has to be updated once certificates are revoked,
+	// so the rest of the operation is not cancelled
+	ctx = context.WithoutCancel(ctx)
+	revoked, err := revokeUserCertificates(ctx, r.Client, r.VaultPKIPath, crts, true, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// All the certificates of the device are revoked, so there is nothing left to defer
+	err = replacePendingRevocations(ctx, r.Client, r.VaultKVPath, func(pr PendingRevocation) bool {
+		return pr.Username == r.Username && pr.Device == device
+	}, []PendingRevocation{})
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, pendingRevocationsKey))
+		return nil, err
+	}
+
+	crl, err := UpdateCRL(ctx,
+		&UpdateCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			VaultKVPath:         r.VaultKVPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			MaxRevocations:      r.MaxRevocations,
+		}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	cn := commonName(r.Username, device)
+	conns, err := terminateConnections(ctx, r.ClientVPNEndpointID, func(conn Connection) bool {
+		return conn.CommonName == cn
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RevokeUserResponse{
+		Revoked:               append(revoked, crl.Revoked...),
+		TerminatedConnections: conns,
+	}, crl.LimitError()
+}
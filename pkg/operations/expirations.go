@@ -0,0 +1,166 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// accessExpirationsKey is the key in the kv store where
+// the scheduled access expirations are persisted
+const accessExpirationsKey = "acpm/access-expirations"
+
+var (
+	// ErrInvalidAccessExpiration is returned when the
+	// requested access end date is not in the future
+	ErrInvalidAccessExpiration = errors.New("invalid access expiration")
+	// ErrAccessExpirationNotFound is returned when the
+	// user has no scheduled access expiration
+	ErrAccessExpirationNotFound = errors.New("access expiration not found")
+)
+
+type accessExpirations struct {
+	Expirations map[string]AccessExpiration `json:"expirations"`
+}
+
+// getAccessExpirations reads the scheduled access expirations from the kv store
+func getAccessExpirations(ctx context.Context, client *api.Client, kvPath string) (map[string]AccessExpiration, error) {
+	data := accessExpirations{}
+	if _, err := readKVData(ctx, client, kvPath, accessExpirationsKey, &data); err != nil {
+		return nil, err
+	}
+	if data.Expirations == nil {
+		return map[string]AccessExpiration{}, nil
+	}
+	return data.Expirations, nil
+}
+
+// setAccessExpiration schedules the access expiration of a user,
+// replacing any previous one. A nil expiration removes it.
+func setAccessExpiration(ctx context.Context, client *api.Client, kvPath string, username string, expiration *AccessExpiration) error {
+	return updateKVData(ctx, client, kvPath, accessExpirationsKey, func(data *accessExpirations) error {
+		if expiration == nil {
+			if _, ok := data.Expirations[username]; !ok {
+				return errKVUnchanged
+			}
+			delete(data.Expirations, username)
+			return nil
+		}
+		if data.Expirations == nil {
+			data.Expirations = map[string]AccessExpiration{}
+		}
+		data.Expirations[username] = *expiration
+		return nil
+	})
+}
+
+// ListAccessExpirationsRequest is the structure containing
+// the required data to list the scheduled access expirations
+type ListAccessExpirationsRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+}
+
+// ListAccessExpirations returns the users whose access
+// is scheduled to end, sorted by expiration date
+func ListAccessExpirations(ctx context.Context, r *ListAccessExpirationsRequest, logger logr.Logger) ([]AccessExpiration, error) {
+	expirations, err := getAccessExpirations(ctx, r.Client, r.VaultKVPath)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to read %s/data/%s from KV2 store", r.VaultKVPath, accessExpirationsKey))
+		return nil, err
+	}
+	list := make([]AccessExpiration, 0, len(expirations))
+	for _, ae := range expirations {
+		list = append(list, ae)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ExpiresAt.Before(list[j].ExpiresAt)
+	})
+	return list, nil
+}
+
+// CancelAccessExpirationRequest is the structure containing
+// the required data to cancel a scheduled access expiration
+type CancelAccessExpirationRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+	Username    string
+}
+
+// CancelAccessExpiration removes the scheduled access expiration of a
+// user, so the user keeps access to the VPN until revoked
+func CancelAccessExpiration(ctx context.Context, r *CancelAccessExpirationRequest, logger logr.Logger) error {
+	err := updateKVData(ctx, r.Client, r.VaultKVPath, accessExpirationsKey, func(data *accessExpirations) error {
+		if _, ok := data.Expirations[r.Username]; !ok {
+			return fmt.Errorf("%w for user %s", ErrAccessExpirationNotFound, r.Username)
+		}
+		delete(data.Expirations, r.Username)
+		return nil
+	})
+	if errors.Is(err, ErrAccessExpirationNotFound) {
+		return err
+	}
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, accessExpirationsKey))
+		return err
+	}
+	logger.Info(fmt.Sprintf("Cancelled access expiration of user %s", r.Username))
+	return nil
+}
+
+// ProcessAccessExpirationsRequest is the structure containing
+// the required data to process the access expirations
+type ProcessAccessExpirationsRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	VaultKVPath         string
+	ClientVPNEndpointID string
+	MaxRevocations      int
+}
+
+// ProcessAccessExpirations revokes the users whose access has ended. It
+// returns the expirations that have been processed, also along with a
+// RevocationLimitError if the CRL updates skipped older certificates.
+func ProcessAccessExpirations(ctx context.Context, r *ProcessAccessExpirationsRequest, logger logr.Logger) ([]AccessExpiration, error) {
+	expirations, err := getAccessExpirations(ctx, r.Client, r.VaultKVPath)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to read %s/data/%s from KV2 store", r.VaultKVPath, accessExpirationsKey))
+		return nil, err
+	}
+
+	processed := []AccessExpiration{}
+	var limitErr error
+	now := time.Now()
+	for username, ae := range expirations {
+		if now.Before(ae.ExpiresAt) {
+			continue
+		}
+		// RevokeUser also removes the expiration from the kv store
+		_, err := RevokeUser(ctx,
+			&RevokeUserRequest{
+				Client:              r.Client,
+				VaultPKIPath:        r.VaultPKIPath,
+				VaultKVPath:         r.VaultKVPath,
+				Username:            username,
+				ClientVPNEndpointID: r.ClientVPNEndpointID,
+				MaxRevocations:      r.MaxRevocations,
+			}, logger)
+		// The user is revoked even if older certificates
+		// of other users were skipped by the CRL update
+		if errors.Is(err, ErrRevocationLimitExceeded) {
+			limitErr, err = err, nil
+		}
+		if err != nil {
+			return processed, err
+		}
+		logger.Info(fmt.Sprintf("Access of user %s ended at %s, revoked", username, ae.ExpiresAt))
+		processed = append(processed, ae)
+	}
+
+	return processed, limitErr
+}
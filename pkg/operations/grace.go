@@ -0,0 +1,224 @@
+package operations
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// pendingRevocationsKey is the key in the kv store where the
+// revocations deferred by a grace period are persisted
+const pendingRevocationsKey = "acpm/pending-revocations"
+
+type pendingRevocations struct {
+	Revocations []PendingRevocation `json:"revocations"`
+}
+
+// getPendingRevocations reads the list of pending revocations from the kv store
+func getPendingRevocations(ctx context.Context, client *api.Client, kvPath string) ([]PendingRevocation, error) {
+	data := pendingRevocations{}
+	if _, err := readKVData(ctx, client, kvPath, pendingRevocationsKey, &data); err != nil {
+		return nil, err
+	}
+	if data.Revocations == nil {
+		return []PendingRevocation{}, nil
+	}
+	return data.Revocations, nil
+}
+
+// replacePendingRevocations replaces the pending revocations that match the
+// given function with the given ones. Passing an empty list removes them.
+func replacePendingRevocations(ctx context.Context, client *api.Client, kvPath string, match func(PendingRevocation) bool, revocations []PendingRevocation) error {
+	return updateKVData(ctx, client, kvPath, pendingRevocationsKey, func(data *pendingRevocations) error {
+		kept := []PendingRevocation{}
+		for _, pr := range data.Revocations {
+			if !match(pr) {
+				kept = append(kept, pr)
+			}
+		}
+		data.Revocations = append(kept, revocations...)
+		return nil
+	})
+}
+
+// deferredSerials returns the serial numbers of the certificates whose
+// revocation has been deferred and whose grace period has not ended
+func deferredSerials(ctx context.Context, client *api.Client, kvPath string) (map[string]bool, error) {
+	deferred := map[string]bool{}
+	if kvPath == "" {
+		return deferred, nil
+	}
+	revocations, err := getPendingRevocations(ctx, client, kvPath)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, pr := range revocations {
+		if now.Before(pr.RevokeAt) {
+			deferred[pr.SerialNumber] = true
+		}
+	}
+	return deferred, nil
+}
+
+// ListPendingRevocationsRequest is the structure containing
+// the required data to list the pending revocations
+type ListPendingRevocationsRequest struct {
+	Client      *api.Client
+	VaultKVPath string
+}
+
+// ListPendingRevocations returns the certificates that are kept valid
+// during a grace period and will be revoked once it ends
+func ListPendingRevocations(ctx context.Context, r *ListPendingRevocationsRequest, logger logr.Logger) ([]PendingRevocation, error) {
+	revocations, err := getPendingRevocations(ctx, r.Client, r.VaultKVPath)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to read %s/data/%s from KV2 store", r.VaultKVPath, pendingRevocationsKey))
+		return nil, err
+	}
+	sort.Slice(revocations, func(i, j int) bool {
+		return revocations[i].RevokeAt.Before(revocations[j].RevokeAt)
+	})
+	return revocations, nil
+}
+
+// ProcessPendingRevocationsRequest is the structure containing
+// the required data to process the pending revocations
+type ProcessPendingRevocationsRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	VaultKVPath         string
+	ClientVPNEndpointID string
+	MaxRevocations      int
+}
+
+// ProcessPendingRevocations revokes the certificates whose grace period
+// has ended and updates the CRL in the Client VPN endpoint. It returns
+// the revocations that have been processed, also along with a
+// RevocationLimitError if the CRL update skipped older certificates.
+func ProcessPendingRevocations(ctx context.Context, r *ProcessPendingRevocationsRequest, logger logr.Logger) ([]PendingRevocation, error) {
+	revocations, err := getPendingRevocations(ctx, r.Client, r.VaultKVPath)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to read %s/data/%s from KV2 store", r.VaultKVPath, pendingRevocationsKey))
+		return nil, err
+	}
+
+	now := time.Now()
+	usernames := []string{}
+	seen := map[string]bool{}
+	for _, pr := range revocations {
+		if !now.Before(pr.RevokeAt) && !seen[pr.Username] {
+			usernames = append(usernames, pr.Username)
+			seen[pr.Username] = true
+		}
+	}
+	if len(usernames) == 0 {
+		return []PendingRevocation{}, nil
+	}
+	sort.Strings(usernames)
+
+	users, err := ListUsers(ctx,
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+		}, logger)
+	if err != nil {
+		return nil, err
+	}
+	crts := map[string]Certificate{}
+	for _, userCrts := range users {
+		for _, crt := range userCrts {
+			crts[crt.SerialNumber] = crt
+		}
+	}
+
+	due := []PendingRevocation{}
+	for _, username := range usernames {
+		processed, err := revokeDueCertificates(ctx, r, username, crts, logger)
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, processed...)
+		// The CRL has to be updated once certificates are
+		// revoked, so the rest of the operation is not cancelled
+		if len(due) > 0 {
+			ctx = context.WithoutCancel(ctx)
+		}
+	}
+	// The revocations might all have been replaced by issues meanwhile
+	if len(due) == 0 {
+		return due, nil
+	}
+
+	crl, err := UpdateCRL(ctx,
+		&UpdateCRLRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			VaultKVPath:         r.VaultKVPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			MaxRevocations:      r.MaxRevocations,
+		}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return due, crl.LimitError()
+}
+
+// revokeDueCertificates revokes the certificates of the user whose grace
+// period has ended. It holds the lock of the user, like the issues and the
+// revocations, so the revocations of the user can't be replaced meanwhile.
+// It returns the revocations that have been processed.
+func revokeDueCertificates(ctx context.Context, r *ProcessPendingRevocationsRequest, username string, crts map[string]Certificate, logger logr.Logger) ([]PendingRevocation, error) {
+	unlock, err := lockUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// The revocations might have been replaced while waiting for the lock
+	revocations, err := getPendingRevocations(ctx, r.Client, r.VaultKVPath)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to read %s/data/%s from KV2 store", r.VaultKVPath, pendingRevocationsKey))
+		return nil, err
+	}
+	now := time.Now()
+	due := []PendingRevocation{}
+	dueSerials := map[string]bool{}
+	for _, pr := range revocations {
+		if pr.Username == username && !now.Before(pr.RevokeAt) {
+			due = append(due, pr)
+			dueSerials[pr.SerialNumber] = true
+		}
+	}
+	if len(due) == 0 {
+		return due, nil
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	for _, pr := range due {
+		// The certificate might have been revoked or tidied in the meantime
+		crt, ok := crts[pr.SerialNumber]
+		if !ok || crt.Revoked {
+			continue
+		}
+		if err := revokeCertificate(ctx, r.Client, r.VaultPKIPath, crt, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only the processed revocations are removed
+	err = replacePendingRevocations(ctx, r.Client, r.VaultKVPath, func(pr PendingRevocation) bool {
+		return dueSerials[pr.SerialNumber] && !now.Before(pr.RevokeAt)
+	}, nil)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, pendingRevocationsKey))
+		return nil, err
+	}
+	return due, nil
+}
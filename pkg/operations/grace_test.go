@@ -0,0 +1,118 @@
+package operations
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+func TestProcessPendingRevocationsHoldsTheUserLock(t *testing.T) {
+	pki := newTestPKI(t)
+	kv := &fakeKV{secrets: map[string]map[string]any{}, versions: map[string]int{}}
+	ctx := context.Background()
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(0x3c4d),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, pki.ca, &pki.key.PublicKey, pki.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := getHexFormatted(tmpl.SerialNumber.Bytes())
+	crl := pki.crl(t, time.Now().Add(time.Hour))
+
+	var revoked atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/secret/"):
+			kv.ServeHTTP(w, r)
+		case r.URL.Path == "/v1/pki-grace/crl/pem":
+			w.Write(crl)
+		case r.URL.Path == "/v1/pki-grace/certs":
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"keys": []string{serial}}})
+		case r.URL.Path == "/v1/pki-grace/cert/"+serial:
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+				"certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			}})
+		case r.URL.Path == "/v1/pki-grace/revoke":
+			revoked.Add(1)
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	cfg.MaxRetries = 0
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := func(PendingRevocation) bool { return true }
+	due := PendingRevocation{SerialNumber: serial, Username: "alice", Device: DefaultDevice, RevokeAt: time.Now().Add(-time.Minute)}
+	if err := replacePendingRevocations(ctx, client, "secret", all, []PendingRevocation{due}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An issue for alice is running
+	unlock, err := lockUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	var processed []PendingRevocation
+	go func() {
+		var err error
+		processed, err = ProcessPendingRevocations(ctx, &ProcessPendingRevocationsRequest{
+			Client:       client,
+			VaultPKIPath: "pki-grace",
+			VaultKVPath:  "secret",
+		}, logr.Discard())
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("ProcessPendingRevocations() = %v while the user is locked", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The issue defers the revocation again before releasing the lock
+	due.RevokeAt = time.Now().Add(time.Hour)
+	if err := replacePendingRevocations(ctx, client, "secret", all, []PendingRevocation{due}); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	if err := <-done; err != nil {
+		t.Fatalf("ProcessPendingRevocations() error = %v", err)
+	}
+	if len(processed) != 0 || revoked.Load() != 0 {
+		t.Errorf("ProcessPendingRevocations() revoked %d certificates (%v), want the deferred one kept", revoked.Load(), processed)
+	}
+	revocations, err := getPendingRevocations(ctx, client, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revocations) != 1 {
+		t.Errorf("pending revocations = %+v, want the one deferred again", revocations)
+	}
+}
@@ -0,0 +1,306 @@
+package operations
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// certIndexPrefix is where the certificate indexes are persisted in
+// the kv store, one folder per PKI with one secret per shard
+const certIndexPrefix = "acpm/cert-index"
+
+// certIndexes caches the certificates of each PKI, so listing the users
+// only reads from Vault the certificates issued since the last listing.
+// Certificates never change once issued, so the index only has to follow
+// the serials listed by the PKI. Revocations are not part of the index,
+// they are always taken from the current CRL.
+var certIndexes = &certIndexSet{indexes: map[string]*certIndex{}}
+
+type certIndexSet struct {
+	mu      sync.Mutex
+	indexes map[string]*certIndex
+}
+
+// get returns the index of the PKI at the given path
+func (cs *certIndexSet) get(pki string) *certIndex {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	ci, ok := cs.indexes[pki]
+	if !ok {
+		ci = &certIndex{pki: pki, entries: map[string]*certIndexEntry{}, dirty: map[string]bool{}}
+		cs.indexes[pki] = ci
+	}
+	return ci
+}
+
+// certIndexEntry is a certificate of the PKI. Certificate is nil
+// for the certificates that are not issued to users, like the CA.
+type certIndexEntry struct {
+	Username    string       `json:"username,omitempty"`
+	Certificate *Certificate `json:"certificate,omitempty"`
+}
+
+type certIndexData struct {
+	Entries map[string]*certIndexEntry `json:"entries"`
+}
+
+// certIndex is the index of the certificates of a PKI
+type certIndex struct {
+	pki string
+	// mu is held while the index is refreshed, so
+	// concurrent listings don't fetch the same serials
+	mu      sync.Mutex
+	loaded  bool
+	entries map[string]*certIndexEntry
+	// dirty are the shards changed since they were last persisted
+	dirty map[string]bool
+	// crlPEM is the last CRL parsed, and revoked its entries
+	crlPEM  []byte
+	revoked map[string]bool
+}
+
+// refresh fetches the certificates listed by the PKI that are not in
+// the index yet, and removes the ones the PKI no longer lists, like the
+// certificates removed by a tidy operation. Must be called holding mu.
+func (ci *certIndex) refresh(ctx context.Context, client *api.Client, logger logr.Logger) error {
+	if !ci.loaded {
+		ci.load(ctx, client, logger)
+		ci.loaded = true
+	}
+
+	secret, err := vaultList(ctx, client, fmt.Sprintf("%s/certs", ci.pki))
+	if err != nil {
+		logger.Error(err, "unable to list certificates")
+		return err
+	}
+	listed := map[string]bool{}
+	if secret != nil && secret.Data["keys"] != nil {
+		for _, key := range secret.Data["keys"].([]any) {
+			listed[key.(string)] = true
+		}
+	}
+
+	for serial := range ci.entries {
+		if !listed[serial] {
+			delete(ci.entries, serial)
+			ci.dirty[certIndexShard(serial)] = true
+		}
+	}
+	fetched := 0
+	for serial := range listed {
+		if _, ok := ci.entries[serial]; ok {
+			continue
+		}
+		entry, err := fetchCertificate(ctx, client, ci.pki, serial, logger)
+		if err != nil {
+			// Keep the certificates fetched so far,
+			// the next refresh continues from there
+			if perr := ci.persist(ctx, client, logger); perr != nil {
+				return errors.Join(err, perr)
+			}
+			return err
+		}
+		ci.entries[serial] = entry
+		ci.dirty[certIndexShard(serial)] = true
+		fetched++
+	}
+	if fetched > 0 {
+		logger.V(1).Info(fmt.Sprintf("%d certificates added to the certificate index", fetched), "pki", ci.pki)
+	}
+	return ci.persist(ctx, client, logger)
+}
+
+// revokedSerials returns the serials revoked by the CRL. The
+// CRL is only parsed again if it has changed since the last call.
+// Must be called holding mu.
+func (ci *certIndex) revokedSerials(crlPEM []byte) (map[string]bool, error) {
+	if ci.revoked != nil && bytes.Equal(crlPEM, ci.crlPEM) {
+		return ci.revoked, nil
+	}
+	list, err := parseCRL(crlPEM)
+	if err != nil {
+		return nil, err
+	}
+	ci.crlPEM, ci.revoked = crlPEM, crlSerials(list)
+	return ci.revoked, nil
+}
+
+// certificates refreshes the index and returns the certificates of the
+// users, with their revocation status taken from the given CRL
+func (ci *certIndex) certificates(ctx context.Context, client *api.Client, crlPEM []byte, logger logr.Logger) (map[string][]Certificate, error) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	if err := ci.refresh(ctx, client, logger); err != nil {
+		return nil, err
+	}
+	revoked, err := ci.revokedSerials(crlPEM)
+	if err != nil {
+		logger.Error(err, "unable to parse the CRL")
+		return nil, err
+	}
+
+	users := map[string][]Certificate{}
+	for _, entry := range ci.entries {
+		if entry.Certificate == nil {
+			continue
+		}
+		crt := *entry.Certificate
+		crt.Revoked = revoked[crt.SerialNumber]
+		users[entry.Username] = append(users[entry.Username], crt)
+	}
+	return users, nil
+}
+
+// certIndexShard returns the shard of the persisted index the serial is
+// stored in: its first byte, so each secret holds a 256th of the index
+func certIndexShard(serial string) string {
+	if len(serial) < 2 {
+		return "00"
+	}
+	return strings.ToLower(serial[:2])
+}
+
+// kvPath returns where the shards of the index are persisted in the kv store
+func (ci *certIndex) kvPath(kind string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", config.CertIndexKVPath, kind, certIndexPrefix,
+		strings.ReplaceAll(strings.Trim(ci.pki, "/"), "/", "_"))
+}
+
+// load reads the persisted index, if persistence is enabled. The index
+// is rebuilt from the PKI if it can't be read, so errors are only logged.
+func (ci *certIndex) load(ctx context.Context, client *api.Client, logger logr.Logger) {
+	if config.CertIndexKVPath == "" {
+		return
+	}
+	secret, err := vaultList(ctx, client, ci.kvPath("metadata"))
+	if err != nil {
+		logger.Error(err, "unable to read the persisted certificate index, rebuilding it")
+		return
+	}
+	if secret == nil || secret.Data["keys"] == nil {
+		return
+	}
+	for _, key := range secret.Data["keys"].([]any) {
+		data, err := ci.readShard(ctx, client, key.(string))
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("unable to read shard %s of the persisted certificate index, rebuilding it", key))
+			continue
+		}
+		for serial, entry := range data.Entries {
+			ci.entries[serial] = entry
+		}
+	}
+}
+
+// readShard reads a shard of the persisted index
+func (ci *certIndex) readShard(ctx context.Context, client *api.Client, shard string) (*certIndexData, error) {
+	data := &certIndexData{}
+	secret, err := vaultRead(ctx, client, fmt.Sprintf("%s/%s", ci.kvPath("data"), shard))
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data["data"] == nil {
+		return data, nil
+	}
+	b, err := json.Marshal(secret.Data["data"])
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// persist writes the shards of the index changed since they were last
+// persisted to the kv store, if persistence is enabled. The shards that
+// can't be written are kept as changed, so the next refresh retries them.
+func (ci *certIndex) persist(ctx context.Context, client *api.Client, logger logr.Logger) error {
+	if config.CertIndexKVPath == "" {
+		clear(ci.dirty)
+		return nil
+	}
+	shards := map[string]map[string]*certIndexEntry{}
+	for shard := range ci.dirty {
+		shards[shard] = map[string]*certIndexEntry{}
+	}
+	for serial, entry := range ci.entries {
+		if entries, ok := shards[certIndexShard(serial)]; ok {
+			entries[serial] = entry
+		}
+	}
+
+	for shard, entries := range shards {
+		b, err := json.Marshal(&certIndexData{Entries: entries})
+		if err != nil {
+			return err
+		}
+		data := map[string]any{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			return err
+		}
+		path := fmt.Sprintf("%s/%s", ci.kvPath("data"), shard)
+		if _, err := vaultWrite(context.WithoutCancel(ctx), client, path, map[string]any{"data": data}); err != nil {
+			logger.Error(err, fmt.Sprintf("unable to update %s in KV2 store", path))
+			return err
+		}
+		delete(ci.dirty, shard)
+	}
+	return nil
+}
+
+// fetchCertificate reads and parses the certificate with the given serial
+func fetchCertificate(ctx context.Context, client *api.Client, pki string, serial string, logger logr.Logger) (*certIndexEntry, error) {
+	secret, err := vaultRead(ctx, client, fmt.Sprintf("%s/cert/%s", pki, serial))
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("error in Vault call to %s/cert/%s", pki, serial))
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("certificate %s not found in %s", serial, pki)
+	}
+	rawCert := secret.Data["certificate"].(string)
+	block, _ := pem.Decode([]byte(rawCert))
+	if block == nil {
+		err := fmt.Errorf("unable to decode PEM encoded certificate %s", serial)
+		logger.Error(err, "failed to decode PEM certificate")
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		logger.Error(err, "failed to parse certificate x509")
+		return nil, err
+	}
+
+	if cert.IsCA || isServerCertificate(cert) {
+		// Do not list the CA
+		return &certIndexEntry{}, nil
+	}
+
+	username, device := parseCommonName(cert.Subject.CommonName)
+	return &certIndexEntry{
+		Username: username,
+		Certificate: &Certificate{
+			SerialNumber:   strings.TrimSpace(getHexFormatted(cert.SerialNumber.Bytes())),
+			IssuerCN:       cert.Issuer.CommonName,
+			SubjectCN:      cert.Subject.CommonName,
+			NotBefore:      cert.NotBefore.Local(),
+			NotAfter:       cert.NotAfter.Local(),
+			CertificatePEM: rawCert,
+			Device:         device,
+		},
+	}, nil
+}
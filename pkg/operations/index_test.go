@@ -0,0 +1,79 @@
+package operations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
+	"github.com/go-logr/logr"
+)
+
+func TestCertIndexPersistsChangedShards(t *testing.T) {
+	kv, client := newFakeKV(t)
+	ctx := context.Background()
+	config.CertIndexKVPath = "secret"
+	t.Cleanup(func() { config.CertIndexKVPath = "" })
+
+	ci := &certIndex{
+		pki: "pki-test",
+		entries: map[string]*certIndexEntry{
+			"1a-01": {Username: "alice", Certificate: &Certificate{SerialNumber: "1a:01", CertificatePEM: "alice-pem"}},
+			"1a-02": {Username: "bob", Certificate: &Certificate{SerialNumber: "1a:02", CertificatePEM: "bob-pem"}},
+			"2b-01": {},
+		},
+		dirty: map[string]bool{"1a": true, "2b": true},
+	}
+	if err := ci.persist(ctx, client, logr.Discard()); err != nil {
+		t.Fatalf("persist() error = %v", err)
+	}
+	if n := kv.writeCount(); n != 2 {
+		t.Errorf("persist() wrote %d secrets, want one per shard", n)
+	}
+
+	// Only the shards changed since are written again
+	ci.entries["2b-02"] = &certIndexEntry{Username: "carol", Certificate: &Certificate{SerialNumber: "2b:02"}}
+	ci.dirty["2b"] = true
+	if err := ci.persist(ctx, client, logr.Discard()); err != nil {
+		t.Fatalf("persist() error = %v", err)
+	}
+	if n := kv.writeCount(); n != 3 {
+		t.Errorf("persist() wrote %d secrets in total, want 3", n)
+	}
+
+	loaded := &certIndex{pki: "pki-test", entries: map[string]*certIndexEntry{}, dirty: map[string]bool{}}
+	loaded.load(ctx, client, logr.Discard())
+	if n := len(loaded.entries); n != 4 {
+		t.Fatalf("load() read %d entries, want 4", n)
+	}
+	if got := loaded.entries["1a-02"]; got.Username != "bob" || got.Certificate.CertificatePEM != "bob-pem" {
+		t.Errorf("load() entry = %+v, want the certificate of bob", got)
+	}
+}
+
+func TestCertIndexPersistReturnsErrors(t *testing.T) {
+	kv, client := newFakeKV(t)
+	ctx := context.Background()
+	config.CertIndexKVPath = "secret"
+	t.Cleanup(func() { config.CertIndexKVPath = "" })
+
+	ci := &certIndex{
+		pki:     "pki-test",
+		entries: map[string]*certIndexEntry{"1a-01": {Username: "alice", Certificate: &Certificate{SerialNumber: "1a:01"}}},
+		dirty:   map[string]bool{"1a": true},
+	}
+	kv.failWrites = true
+	if err := ci.persist(ctx, client, logr.Discard()); err == nil {
+		t.Fatalf("persist() error = nil, want the write error")
+	}
+	if !ci.dirty["1a"] {
+		t.Errorf("shard that failed to be written is no longer marked as changed")
+	}
+
+	kv.failWrites = false
+	if err := ci.persist(ctx, client, logr.Discard()); err != nil {
+		t.Fatalf("persist() error = %v", err)
+	}
+	if len(ci.dirty) != 0 {
+		t.Errorf("shards %v still marked as changed after being written", ci.dirty)
+	}
+}
@@ -0,0 +1,118 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// kvUpdateRetries is how many times updateKVData retries
+// an update that conflicts with a concurrent one
+const kvUpdateRetries = 5
+
+// errKVUnchanged is returned by the update functions of
+// updateKVData when the data doesn't have to be written
+var errKVUnchanged = errors.New("kv data unchanged")
+
+// readKVData reads a secret from the kv (v2) store and decodes its data
+// into v. It returns false if the secret does not exist.
+func readKVData(ctx context.Context, client *api.Client, kvPath string, key string, v any) (bool, error) {
+	secret, err := vaultRead(ctx, client, fmt.Sprintf("%s/data/%s", kvPath, key))
+	if err != nil {
+		return false, err
+	}
+	if secret == nil || secret.Data["data"] == nil {
+		return false, nil
+	}
+	b, err := json.Marshal(secret.Data["data"])
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// updateKVData reads the data of a secret in the kv (v2) store, changes it
+// with update and writes it back with check-and-set, so concurrent updates
+// of the same secret, from this process or from other replicas, are never
+// lost. The update is retried with the new data if another one wins.
+func updateKVData[T any](ctx context.Context, client *api.Client, kvPath string, key string, update func(*T) error) error {
+	path := fmt.Sprintf("%s/data/%s", kvPath, key)
+	for attempt := 0; ; attempt++ {
+		secret, err := vaultRead(ctx, client, path)
+		if err != nil {
+			return err
+		}
+		data := new(T)
+		version := 0
+		if secret != nil {
+			if version, err = kvVersion(secret); err != nil {
+				return err
+			}
+			if secret.Data["data"] != nil {
+				b, err := json.Marshal(secret.Data["data"])
+				if err != nil {
+					return err
+				}
+				if err := json.Unmarshal(b, data); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := update(data); err != nil {
+			if errors.Is(err, errKVUnchanged) {
+				return nil
+			}
+			return err
+		}
+
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		encoded := map[string]any{}
+		if err := json.Unmarshal(b, &encoded); err != nil {
+			return err
+		}
+		_, err = vaultWrite(ctx, client, path, map[string]any{
+			"options": map[string]any{"cas": version},
+			"data":    encoded,
+		})
+		if !isCASError(err) {
+			return err
+		}
+		if attempt >= kvUpdateRetries {
+			return fmt.Errorf("unable to update %s: too many concurrent updates", path)
+		}
+	}
+}
+
+// kvVersion returns the version of a secret read from the kv (v2) store
+func kvVersion(secret *api.Secret) (int, error) {
+	md, ok := secret.Data["metadata"].(map[string]any)
+	if !ok {
+		return 0, nil
+	}
+	v, ok := md["version"].(json.Number)
+	if !ok {
+		return 0, nil
+	}
+	n, err := v.Int64()
+	return int(n), err
+}
+
+// isCASError returns true if a write to the kv (v2) store failed
+// because the secret was changed since the version it was based on
+func isCASError(err error) bool {
+	var rspErr *api.ResponseError
+	return errors.As(err, &rspErr) && rspErr.StatusCode == http.StatusBadRequest &&
+		strings.Contains(strings.Join(rspErr.Errors, " "), "check-and-set")
+}
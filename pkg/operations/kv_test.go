@@ -0,0 +1,240 @@
+package operations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// fakeKV is a kv (v2) store that honors check-and-set
+type fakeKV struct {
+	mu       sync.Mutex
+	secrets  map[string]map[string]any
+	versions map[string]int
+	writes   int
+	// failWrites makes every write fail
+	failWrites bool
+}
+
+// writeCount returns how many secrets have been written
+func (kv *fakeKV) writeCount() int {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.writes
+}
+
+// newFakeKV serves a fake kv store mounted at "secret"
+// and returns a Vault client that uses it
+func newFakeKV(t *testing.T) (*fakeKV, *api.Client) {
+	t.Helper()
+	kv := &fakeKV{secrets: map[string]map[string]any{}, versions: map[string]int{}}
+	srv := httptest.NewServer(kv)
+	t.Cleanup(srv.Close)
+
+	cfg := api.DefaultConfig()
+	cfg.Address = srv.URL
+	cfg.MaxRetries = 0
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv, client
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if prefix, ok := strings.CutPrefix(r.URL.Path, "/v1/secret/metadata/"); ok {
+		keys := []string{}
+		for key := range kv.secrets {
+			if rest, ok := strings.CutPrefix(key, prefix+"/"); ok {
+				keys = append(keys, rest)
+			}
+		}
+		if len(keys) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"keys": keys}})
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/v1/secret/data/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := kv.secrets[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"data": map[string]any{
+				"data":     data,
+				"metadata": map[string]any{"version": kv.versions[key]},
+			},
+		})
+	case http.MethodPut, http.MethodPost:
+		body := struct {
+			Options map[string]any `json:"options"`
+			Data    map[string]any `json:"data"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if kv.failWrites {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errors":["storage unavailable"]}`))
+			return
+		}
+		if cas, ok := body.Options["cas"].(float64); ok && int(cas) != kv.versions[key] {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errors":["check-and-set parameter did not match the current version"]}`))
+			return
+		}
+		kv.secrets[key] = body.Data
+		kv.versions[key]++
+		kv.writes++
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"version": kv.versions[key]}})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestUpdateKVDataRetriesConcurrentUpdates(t *testing.T) {
+	kv, client := newFakeKV(t)
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	// Another replica schedules the expiration of bob between
+	// the read and the write of the expiration of alice
+	attempts := 0
+	err := updateKVData(ctx, client, "secret", accessExpirationsKey, func(data *accessExpirations) error {
+		attempts++
+		if attempts == 1 {
+			if err := setAccessExpiration(ctx, client, "secret", "bob", &AccessExpiration{Username: "bob", ExpiresAt: expiresAt}); err != nil {
+				return err
+			}
+		}
+		if data.Expirations == nil {
+			data.Expirations = map[string]AccessExpiration{}
+		}
+		data.Expirations["alice"] = AccessExpiration{Username: "alice", ExpiresAt: expiresAt}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("updateKVData() error = %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("update ran %d times, want 2", attempts)
+	}
+
+	expirations, err := getAccessExpirations(ctx, client, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expirations) != 2 {
+		t.Errorf("got expirations %v, want alice and bob", expirations)
+	}
+
+	// Removing an expiration that doesn't exist doesn't write
+	writes := kv.writeCount()
+	if err := setAccessExpiration(ctx, client, "secret", "carol", nil); err != nil {
+		t.Fatal(err)
+	}
+	if kv.writeCount() != writes {
+		t.Errorf("unchanged data was written")
+	}
+}
+
+func TestUpdateKVDataGivesUp(t *testing.T) {
+	_, client := newFakeKV(t)
+	ctx := context.Background()
+
+	err := updateKVData(ctx, client, "secret", "counter", func(data *map[string]int) error {
+		// Every attempt loses against a concurrent update
+		return updateKVData(ctx, client, "secret", "counter", func(data *map[string]int) error {
+			if *data == nil {
+				*data = map[string]int{}
+			}
+			(*data)["n"]++
+			return nil
+		})
+	})
+	if err == nil || !strings.Contains(err.Error(), "too many concurrent updates") {
+		t.Errorf("updateKVData() error = %v, want too many concurrent updates", err)
+	}
+}
+
+func TestCancelAccessExpirationNotFound(t *testing.T) {
+	_, client := newFakeKV(t)
+
+	err := CancelAccessExpiration(context.Background(), &CancelAccessExpirationRequest{
+		Client:      client,
+		VaultKVPath: "secret",
+		Username:    "alice",
+	}, logr.Discard())
+	if !errors.Is(err, ErrAccessExpirationNotFound) {
+		t.Errorf("CancelAccessExpiration() error = %v, want ErrAccessExpirationNotFound", err)
+	}
+}
+
+func TestAPIKeysConcurrentCreateAndRevoke(t *testing.T) {
+	_, client := newFakeKV(t)
+	ctx := context.Background()
+	logger := logr.Discard()
+
+	var wg sync.WaitGroup
+	ids := make(chan string, 3)
+	for _, name := range []string{"ci", "deploy", "backup"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, key, err := CreateAPIKey(ctx, &CreateAPIKeyRequest{
+				Client:      client,
+				VaultKVPath: "secret",
+				Name:        name,
+				ExpiresAt:   time.Now().Add(time.Hour),
+			}, logger)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids <- key.ID
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	keys, err := ListAPIKeys(ctx, &ListAPIKeysRequest{Client: client, VaultKVPath: "secret"}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("got %d API keys, want 3", len(keys))
+	}
+
+	id := <-ids
+	if _, err := RevokeAPIKey(ctx, &RevokeAPIKeyRequest{Client: client, VaultKVPath: "secret", ID: id}, logger); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RevokeAPIKey(ctx, &RevokeAPIKeyRequest{Client: client, VaultKVPath: "secret", ID: id}, logger); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("RevokeAPIKey() error = %v, want ErrAPIKeyNotFound", err)
+	}
+}
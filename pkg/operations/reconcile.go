@@ -0,0 +1,116 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/vault/api"
+)
+
+// ReconcileUsersRequest is the structure containing the
+// required data to reconcile the VPN users with a list of members
+type ReconcileUsersRequest struct {
+	Client              *api.Client
+	VaultPKIPath        string
+	VaultKVPath         string
+	ClientVPNEndpointID string
+	Members             []string
+	DryRun              bool
+	MaxRevocations      int
+}
+
+// ReconcileUsersResponse is the structure containing
+// the result of a reconciliation
+type ReconcileUsersResponse struct {
+	Flagged []string `json:"flagged"`
+	Revoked []string `json:"revoked"`
+}
+
+// ReconcileUsers revokes all the users that still have a valid certificate but
+// are not in the list of members anymore. If DryRun is set, the users are only
+// flagged and nothing gets revoked.
+func ReconcileUsers(ctx context.Context, r *ReconcileUsersRequest, logger logr.Logger) (*ReconcileUsersResponse, error) {
+	rsp := &ReconcileUsersResponse{Flagged: []string{}, Revoked: []string{}}
+
+	// An empty list of members most likely means that something went wrong
+	// retrieving it, so refuse to continue instead of revoking everyone
+	if len(r.Members) == 0 {
+		return nil, errors.New("refusing to reconcile users against an empty list of members")
+	}
+
+	members := map[string]bool{}
+	for _, m := range r.Members {
+		members[strings.ToLower(m)] = true
+	}
+
+	users, err := ListUsers(ctx,
+		&ListUsersRequest{
+			Client:              r.Client,
+			VaultPKIPath:        r.VaultPKIPath,
+			ClientVPNEndpointID: r.ClientVPNEndpointID,
+		}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	for username, crts := range users {
+		if members[strings.ToLower(username)] || !hasActiveCertificate(crts) {
+			continue
+		}
+		rsp.Flagged = append(rsp.Flagged, username)
+	}
+	sort.Strings(rsp.Flagged)
+
+	if !r.DryRun && r.MaxRevocations > 0 && len(rsp.Flagged) > r.MaxRevocations {
+		logger.WithValues("users", rsp.Flagged, "limit", r.MaxRevocations).
+			Info("Reconciliation aborted, revocation limit exceeded")
+		return rsp, fmt.Errorf("%w: %d users would be revoked but the limit is %d",
+			ErrRevocationLimitExceeded, len(rsp.Flagged), r.MaxRevocations)
+	}
+
+	var limitErr error
+	for _, username := range rsp.Flagged {
+		if r.DryRun {
+			logger.Info(fmt.Sprintf("User %s is not a member anymore (dry-run, not revoked)", username))
+			continue
+		}
+		_, err := RevokeUser(ctx,
+			&RevokeUserRequest{
+				Client:              r.Client,
+				VaultPKIPath:        r.VaultPKIPath,
+				VaultKVPath:         r.VaultKVPath,
+				Username:            username,
+				ClientVPNEndpointID: r.ClientVPNEndpointID,
+				MaxRevocations:      r.MaxRevocations,
+			}, logger)
+		// The user is revoked even if older certificates
+		// of other users were skipped by the CRL update
+		if errors.Is(err, ErrRevocationLimitExceeded) {
+			limitErr, err = err, nil
+		}
+		if err != nil {
+			return rsp, err
+		}
+		logger.Info(fmt.Sprintf("User %s is not a member anymore, revoked", username))
+		rsp.Revoked = append(rsp.Revoked, username)
+	}
+
+	return rsp, limitErr
+}
+
+// hasActiveCertificate returns true if any of the certificates
+// is neither revoked nor expired
+func hasActiveCertificate(crts []Certificate) bool {
+	now := time.Now()
+	for _, crt := range crts {
+		if !crt.Revoked && now.Before(crt.NotAfter) {
+			return true
+		}
+	}
+	return false
+}
@@ -12,4 +12,83 @@ type Certificate struct {
 	NotAfter       time.Time `json:"notAfter"`
 	Revoked        bool      `json:"revoked"`
 	CertificatePEM string    `json:"certificate-pem"`
+	Device         string    `json:"device"`
+}
+
+// Connection represents a client connection
+// to the AWS Client VPN endpoint
+type Connection struct {
+	ConnectionID    string    `json:"connectionId"`
+	CommonName      string    `json:"commonName"`
+	Status          string    `json:"status"`
+	ClientIP        string    `json:"clientIp"`
+	EstablishedTime time.Time `json:"establishedTime"`
+	EndTime         time.Time `json:"endTime,omitempty"`
+	IngressBytes    int64     `json:"ingressBytes"`
+	EgressBytes     int64     `json:"egressBytes"`
+}
+
+// UserActivity represents the certificates of a user together with
+// the connections the user has established to the AWS Client VPN endpoint
+type UserActivity struct {
+	Certificates []Certificate `json:"certificates"`
+	Connections  []Connection  `json:"connections"`
+	Connected    bool          `json:"connected"`
+	LastSeen     *time.Time    `json:"lastSeen,omitempty"`
+}
+
+// PendingRevocation represents a certificate that is kept
+// valid during a grace period after a new certificate has
+// been issued for the same user
+type PendingRevocation struct {
+	SerialNumber string    `json:"serial"`
+	SubjectCN    string    `json:"subjectCN"`
+	Username     string    `json:"username"`
+	Device       string    `json:"device"`
+	RevokeAt     time.Time `json:"revokeAt"`
+}
+
+// AccessExpiration represents the scheduled
+// end of the VPN access of a user
+type AccessExpiration struct {
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// CRLInfo represents the validity information
+// of a Certificate Revocation List
+type CRLInfo struct {
+	ThisUpdate time.Time `json:"thisUpdate"`
+	NextUpdate time.Time `json:"nextUpdate"`
+	Remaining  string    `json:"remaining"`
+	Entries    int       `json:"entries"`
+}
+
+// CRLStatus represents the state of both the CRL in the Vault
+// PKI and the CRL imported into the AWS Client VPN endpoint
+type CRLStatus struct {
+	Vault    *CRLInfo `json:"vault"`
+	Endpoint *CRLInfo `json:"endpoint"`
+}
+
+// NextUpdate returns the earliest NextUpdate of both CRLs. If the endpoint
+// has no CRL imported, the NextUpdate of the Vault CRL is returned.
+func (s *CRLStatus) NextUpdate() time.Time {
+	if s.Endpoint != nil && s.Endpoint.NextUpdate.Before(s.Vault.NextUpdate) {
+		return s.Endpoint.NextUpdate
+	}
+	return s.Vault.NextUpdate
+}
+
+// APIKey represents a service API key. The secret part of
+// the key is never stored, only its sha256 hash.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	CreatedAt time.Time `json:"createdAt"`
+	CreatedBy string    `json:"createdBy"`
+	Hash      string    `json:"hash,omitempty"`
 }
@@ -2,16 +2,38 @@ package operations
 
 import (
 	"bytes"
+	"context"
 	"crypto/x509"
-	"encoding/pem"
+	"errors"
 	"fmt"
+	"regexp"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/metrics"
 	"github.com/go-logr/logr"
 	"github.com/hashicorp/vault/api"
 )
 
+var (
+	// ErrInvalidUsername is returned when a username
+	// can't be used as a certificate common name
+	ErrInvalidUsername = errors.New("invalid username")
+
+	usernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+)
+
+// validateUsername checks that the username can be used as a certificate
+// common name. '@' separates the username from the device in the common
+// name, so a username with it would be taken for another user's device.
+func validateUsername(username string) error {
+	if !usernameRegexp.MatchString(username) {
+		return fmt.Errorf("%w '%s': only letters, numbers, '.', '_' and '-' are allowed", ErrInvalidUsername, username)
+	}
+	return nil
+}
+
 // ListUsersRequest is the structure containing
 // the required data to issue a new certificate
 type ListUsersRequest struct {
@@ -20,18 +42,12 @@ type ListUsersRequest struct {
 	ClientVPNEndpointID string
 }
 
-// ListUsers retrieves the list of all Client VPN users and certificates
-func ListUsers(r *ListUsersRequest, logger logr.Logger) (map[string][]Certificate, error) {
-	users := map[string][]Certificate{}
-
-	secret, err := r.Client.Logical().List(fmt.Sprintf("%s/certs", r.VaultPKIPath))
-	if err != nil {
-		logger.Error(err, "unable to list certificates")
-		return nil, err
-	}
-
+// ListUsers retrieves the list of all Client VPN users and certificates.
+// The certificates come from the index of the PKI, which only reads
+// from Vault the certificates it hasn't seen yet.
+func ListUsers(ctx context.Context, r *ListUsersRequest, logger logr.Logger) (map[string][]Certificate, error) {
 	// Get the updated CRL
-	crl, err := GetCRL(
+	crl, err := GetCRL(ctx,
 		&GetCRLRequest{
 			Client:       r.Client,
 			VaultPKIPath: r.VaultPKIPath,
@@ -40,49 +56,9 @@ func ListUsers(r *ListUsersRequest, logger logr.Logger) (map[string][]Certificat
 		return nil, err
 	}
 
-	for _, key := range secret.Data["keys"].([]any) {
-		secret, err := r.Client.Logical().Read(fmt.Sprintf("%s/cert/%s", r.VaultPKIPath, key))
-		if err != nil {
-			logger.Error(err, fmt.Sprintf("error in Vault call to %s/cert/%s", r.VaultPKIPath, key))
-			return nil, err
-		}
-		rawCert := secret.Data["certificate"].(string)
-		block, _ := pem.Decode([]byte(rawCert))
-		if block == nil {
-			logger.Error(err, "failed to decode PEM certificate")
-			return nil, err
-		}
-
-		cert, err := x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			logger.Error(err, "failed to parse certificate x509")
-			return nil, err
-		}
-
-		if cert.IsCA || isServerCertificate(cert) {
-			// Do not list the CA
-			continue
-		}
-
-		notBefore := cert.NotBefore.Local()
-		notAfter := cert.NotAfter.Local()
-		serial := strings.TrimSpace(getHexFormatted(cert.SerialNumber.Bytes()))
-		revoked, err := isRevoked(serial, crl)
-		if err != nil {
-			logger.Error(err, "error in call to 'isRevoked'")
-			return nil, err
-		}
-
-		username := strings.Split(cert.Subject.CommonName, "@")[0]
-		users[username] = append(users[username], Certificate{
-			serial,
-			cert.Issuer.CommonName,
-			cert.Subject.CommonName,
-			notBefore,
-			notAfter,
-			revoked,
-			rawCert,
-		})
+	users, err := certIndexes.get(r.VaultPKIPath).certificates(ctx, r.Client, crl, logger)
+	if err != nil {
+		return nil, err
 	}
 
 	// Sort the arrays but notBefore date (which should be the
@@ -92,50 +68,145 @@ func ListUsers(r *ListUsersRequest, logger logr.Logger) (map[string][]Certificat
 			return crts[i].NotBefore.Before(crts[j].NotBefore)
 		})
 	}
+	updateCertificateMetrics(users)
 
 	return users, nil
 }
 
+// updateCertificateMetrics sets the certificate gauges from the list of users
+func updateCertificateMetrics(users map[string][]Certificate) {
+	now := time.Now()
+	var active, revoked, expired, multiple int
+	var nextExpiry time.Time
+	for _, crts := range users {
+		// Each device is expected to have a single active certificate
+		deviceActive := map[string]int{}
+		for _, crt := range crts {
+			switch {
+			case crt.Revoked:
+				revoked++
+			case !now.Before(crt.NotAfter):
+				expired++
+			default:
+				active++
+				_, device := parseCommonName(crt.SubjectCN)
+				deviceActive[device]++
+				if nextExpiry.IsZero() || crt.NotAfter.Before(nextExpiry) {
+					nextExpiry = crt.NotAfter
+				}
+			}
+		}
+		for _, n := range deviceActive {
+			if n > 1 {
+				multiple++
+				break
+			}
+		}
+	}
+	metrics.Certificates.WithLabelValues("active").Set(float64(active))
+	metrics.Certificates.WithLabelValues("revoked").Set(float64(revoked))
+	metrics.Certificates.WithLabelValues("expired").Set(float64(expired))
+	metrics.UsersWithMultipleActiveCertificates.Set(float64(multiple))
+	if !nextExpiry.IsZero() {
+		metrics.NextCertificateExpiryDays.Set(nextExpiry.Sub(now).Hours() / 24)
+	}
+}
+
 // RevokeUserRequest is the structure containing
 // the required data to issue a new certificate
 type RevokeUserRequest struct {
 	Client              *api.Client
 	VaultPKIPath        string
+	VaultKVPath         string
 	Username            string
 	ClientVPNEndpointID string
+	MaxRevocations      int
+}
+
+// RevokeUserResponse is the structure containing
+// the result of a user revocation
+type RevokeUserResponse struct {
+	// Revoked are the serial numbers of the revoked certificates
+	Revoked               []string     `json:"revoked"`
+	TerminatedConnections []Connection `json:"terminatedConnections"`
 }
 
-// RevokeUser revokes all the issued certificates for a given user
-func RevokeUser(r *RevokeUserRequest, logger logr.Logger) error {
+// RevokeUser revokes all the issued certificates for a given user and
+// terminates any active session the user has in the Client VPN endpoint.
+// The response is also returned with a RevocationLimitError if the CRL
+// update skipped older certificates because of the revocation limit.
+func RevokeUser(ctx context.Context, r *RevokeUserRequest, logger logr.Logger) (*RevokeUserResponse, error) {
+	if err := validateUsername(r.Username); err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockUser(ctx, r.Username)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 	// Get the list of users
-	users, err := ListUsers(
+	users, err := ListUsers(ctx,
 		&ListUsersRequest{
 			Client:              r.Client,
 			VaultPKIPath:        r.VaultPKIPath,
 			ClientVPNEndpointID: r.ClientVPNEndpointID,
 		}, logger)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = revokeUserCertificates(r.Client, r.VaultPKIPath, users[r.Username], true, logger)
+	// The CRL has to be updated once certificates are revoked,
+	// so the rest of the operation is not cancelled
+	ctx = context.WithoutCancel(ctx)
+	revoked, err := revokeUserCertificates(ctx, r.Client, r.VaultPKIPath, users[r.Username], true, logger)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// All the certificates are revoked, so there is nothing left to defer
+	err = replacePendingRevocations(ctx, r.Client, r.VaultKVPath, func(pr PendingRevocation) bool {
+		return pr.Username == r.Username
+	}, []PendingRevocation{})
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, pendingRevocationsKey))
+		return nil, err
+	}
+
+	// The access has ended, so there is no expiration left to schedule
+	if err := setAccessExpiration(ctx, r.Client, r.VaultKVPath, r.Username, nil); err != nil {
+		logger.Error(err, fmt.Sprintf("unable to update %s/data/%s in KV2 store", r.VaultKVPath, accessExpirationsKey))
+		return nil, err
 	}
 
 	// Call UpdateCRL to revoke all other certificates
-	_, err = UpdateCRL(
+	crl, err := UpdateCRL(ctx,
 		&UpdateCRLRequest{
 			Client:              r.Client,
 			VaultPKIPath:        r.VaultPKIPath,
+			VaultKVPath:         r.VaultKVPath,
 			ClientVPNEndpointID: r.ClientVPNEndpointID,
+			MaxRevocations:      r.MaxRevocations,
 		}, logger)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	// Kill the sessions that are still open. This is done after the CRL
+	// has been updated in the endpoint so the user is not able to reconnect
+	conns, err := terminateConnections(ctx, r.ClientVPNEndpointID, func(conn Connection) bool {
+		username, _ := parseCommonName(conn.CommonName)
+		return username == r.Username
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RevokeUserResponse{
+		Revoked:               append(revoked, crl.Revoked...),
+		TerminatedConnections: conns,
+	}, crl.LimitError()
 }
 
 func getHexFormatted(buf []byte) string {
@@ -149,24 +220,13 @@ func getHexFormatted(buf []byte) string {
 	return ret.String()
 }
 
-func isRevoked(serial string, crlPEM []byte) (bool, error) {
-	// PEM to DER
-	var crl []byte
-	block, _ := pem.Decode(crlPEM)
-	if block != nil && block.Type == "X509 CRL" {
-		crl = block.Bytes
-	}
-	// Parse CRL
-	list, err := x509.ParseRevocationList(crl)
-	if err != nil {
-		return false, err
-	}
+// crlSerials returns the serials of the certificates revoked by the CRL
+func crlSerials(list *x509.RevocationList) map[string]bool {
+	serials := make(map[string]bool, len(list.RevokedCertificateEntries))
 	for _, entry := range list.RevokedCertificateEntries {
-		if serial == strings.TrimSpace(getHexFormatted(entry.SerialNumber.Bytes())) {
-			return true, nil
-		}
+		serials[strings.TrimSpace(getHexFormatted(entry.SerialNumber.Bytes()))] = true
 	}
-	return false, nil
+	return serials
 }
 
 func isServerCertificate(cert *x509.Certificate) bool {
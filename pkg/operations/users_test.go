@@ -0,0 +1,73 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/metrics"
+	"github.com/go-logr/logr"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestValidateUsername(t *testing.T) {
+	for _, username := range []string{"alice", "Alice-Smith", "a.smith_2"} {
+		if err := validateUsername(username); err != nil {
+			t.Errorf("validateUsername(%q) = %v, want nil", username, err)
+		}
+	}
+	for _, username := range []string{"", "alice@laptop", "-alice", "../alice", "alice bob", "alice/x"} {
+		if err := validateUsername(username); !errors.Is(err, ErrInvalidUsername) {
+			t.Errorf("validateUsername(%q) = %v, want ErrInvalidUsername", username, err)
+		}
+	}
+}
+
+func TestOperationsRejectInvalidUsernames(t *testing.T) {
+	ctx := context.Background()
+	logger := logr.Discard()
+
+	// The username is checked before Vault is used, so no client is needed
+	if _, err := IssueClientCertificate(ctx, &IssueCertificateRequest{Username: "alice@x"}, logger); !errors.Is(err, ErrInvalidUsername) {
+		t.Errorf("IssueClientCertificate() error = %v, want ErrInvalidUsername", err)
+	}
+	if _, err := RevokeUser(ctx, &RevokeUserRequest{Username: "alice@x"}, logger); !errors.Is(err, ErrInvalidUsername) {
+		t.Errorf("RevokeUser() error = %v, want ErrInvalidUsername", err)
+	}
+	if _, err := RevokeDevice(ctx, &RevokeDeviceRequest{Username: "alice@x", Device: "laptop"}, logger); !errors.Is(err, ErrInvalidUsername) {
+		t.Errorf("RevokeDevice() error = %v, want ErrInvalidUsername", err)
+	}
+}
+
+func TestUpdateCertificateMetricsCountsDuplicatesPerDevice(t *testing.T) {
+	valid := time.Now().Add(time.Hour)
+	users := map[string][]Certificate{
+		// One active certificate per device
+		"alice": {
+			{SubjectCN: "alice", NotAfter: valid},
+			{SubjectCN: "alice@laptop", NotAfter: valid},
+			{SubjectCN: "alice@laptop", NotAfter: valid, Revoked: true},
+		},
+		// Two active certificates for the laptop
+		"bob": {
+			{SubjectCN: "bob@laptop", NotAfter: valid},
+			{SubjectCN: "bob@laptop", NotAfter: valid},
+			{SubjectCN: "bob@phone", NotAfter: valid},
+		},
+		// Two active certificates for the default device
+		"carol": {
+			{SubjectCN: "carol", NotAfter: valid},
+			{SubjectCN: "carol", NotAfter: valid},
+		},
+	}
+
+	updateCertificateMetrics(users)
+	m := &dto.Metric{}
+	if err := metrics.UsersWithMultipleActiveCertificates.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 2 {
+		t.Errorf("users with multiple active certificates = %v, want 2", got)
+	}
+}
@@ -0,0 +1,64 @@
+package operations
+
+import (
+	"context"
+	"io"
+
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/tracing"
+	"github.com/hashicorp/vault/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer(tracing.ServiceName + "/operations")
+
+// vaultContext starts a span for a call to Vault and returns the
+// context the call has to be made with, bounded by the Vault timeout.
+func vaultContext(ctx context.Context, method string, path string) (context.Context, context.CancelFunc, trace.Span) {
+	ctx, span := tracer.Start(ctx, "vault."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("vault.path", path)),
+	)
+	ctx, cancel := context.WithTimeout(ctx, config.VaultApiTimeout)
+	return ctx, cancel, span
+}
+
+// vaultRead reads the secret at path
+func vaultRead(ctx context.Context, client *api.Client, path string) (*api.Secret, error) {
+	ctx, cancel, span := vaultContext(ctx, "read", path)
+	defer cancel()
+	secret, err := client.Logical().ReadWithContext(ctx, path)
+	return secret, tracing.End(span, err)
+}
+
+// vaultReadRaw returns the unparsed body of the response at path,
+// for the endpoints that don't return JSON, like the PEM ones
+func vaultReadRaw(ctx context.Context, client *api.Client, path string) ([]byte, error) {
+	ctx, cancel, span := vaultContext(ctx, "read", path)
+	defer cancel()
+	rsp, err := client.Logical().ReadRawWithContext(ctx, path)
+	if err != nil {
+		return nil, tracing.End(span, err)
+	}
+	defer rsp.Body.Close()
+	data, err := io.ReadAll(rsp.Body)
+	return data, tracing.End(span, err)
+}
+
+// vaultList lists the keys at path
+func vaultList(ctx context.Context, client *api.Client, path string) (*api.Secret, error) {
+	ctx, cancel, span := vaultContext(ctx, "list", path)
+	defer cancel()
+	secret, err := client.Logical().ListWithContext(ctx, path)
+	return secret, tracing.End(span, err)
+}
+
+// vaultWrite writes the data to path
+func vaultWrite(ctx context.Context, client *api.Client, path string, data map[string]any) (*api.Secret, error) {
+	ctx, cancel, span := vaultContext(ctx, "write", path)
+	defer cancel()
+	secret, err := client.Logical().WriteWithContext(ctx, path, data)
+	return secret, tracing.End(span, err)
+}
@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName is the name of the service in the traces
+const ServiceName = "aws-cvpn-pki-manager"
+
+// Protocols supported to export the traces
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http/protobuf"
+)
+
+// Options configures the export of the traces
+type Options struct {
+	// Endpoint is the address of the OTLP collector. Tracing
+	// is disabled if empty.
+	Endpoint string
+	// Protocol is either ProtocolGRPC or ProtocolHTTP
+	Protocol string
+	// Insecure disables TLS when talking to the collector
+	Insecure bool
+	// SampleRatio is the fraction of the traces that are
+	// sampled, unless the parent span says otherwise
+	SampleRatio float64
+}
+
+// Setup registers the global tracer provider that exports the traces to the
+// OTLP collector. When tracing is disabled, the default no-op provider is
+// kept. The returned function flushes the pending spans and must be called
+// before exiting.
+func Setup(ctx context.Context, opts *Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter *otlptrace.Exporter
+	var err error
+	switch opts.Protocol {
+	case ProtocolGRPC:
+		grpcOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(opts.Endpoint)}
+		if opts.Insecure {
+			grpcOpts = append(grpcOpts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, grpcOpts...)
+	case ProtocolHTTP:
+		httpOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+		if opts.Insecure {
+			httpOpts = append(httpOpts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, httpOpts...)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol '%s', use '%s' or '%s'", opts.Protocol, ProtocolGRPC, ProtocolHTTP)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Resource attributes from the OTEL_RESOURCE_ATTRIBUTES
+	// and OTEL_SERVICE_NAME variables take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", ServiceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// End records the error, if any, in the span and ends it.
+// It returns the error so it can be used in return statements.
+func End(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
+
+// InstrumentAWS adds a middleware to the stack of the AWS clients that
+// records a span for each call. Use it in the APIOptions of the AWS config.
+func InstrumentAWS(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("ACPMTracing",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (
+			middleware.InitializeOutput, middleware.Metadata, error,
+		) {
+			service, operation := awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx)
+			ctx, span := otel.Tracer(ServiceName).Start(ctx, service+"."+operation,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(
+					attribute.String("rpc.system", "aws-api"),
+					attribute.String("rpc.service", service),
+					attribute.String("rpc.method", operation),
+				))
+			out, md, err := next.HandleInitialize(ctx, in)
+			if requestID, ok := awsmiddleware.GetRequestIDMetadata(md); ok {
+				span.SetAttributes(attribute.String("aws.request_id", requestID))
+			}
+			return out, md, End(span, err)
+		}), middleware.After)
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/3scale/aws-cvpn-pki-manager/pkg/config"
+	"github.com/3scale/aws-cvpn-pki-manager/pkg/metrics"
 	"github.com/go-logr/logr"
 	"github.com/hashicorp/vault/api"
 	auth "github.com/hashicorp/vault/api/auth/approle"
@@ -15,6 +17,21 @@ import (
 // client that can talk to the vault server
 type AuthenticatedClient interface {
 	GetClient(logr.Logger) (*api.Client, error)
+	// Close stops the background renewal of the
+	// credentials, if any. The client can't be used after.
+	Close()
+}
+
+// loginRetryInterval is the delay between attempts
+// to log in when the auth backend fails
+const loginRetryInterval time.Duration = 10 * time.Second
+
+// newConfig returns the default Vault client
+// config, instrumented to record metrics
+func newConfig() *api.Config {
+	cfg := api.DefaultConfig()
+	cfg.HttpClient.Transport = metrics.InstrumentVault(cfg.HttpClient.Transport)
+	return cfg
 }
 
 // TokenAuthenticatedClient is the config
@@ -36,7 +53,7 @@ func (tac *TokenAuthenticatedClient) GetClient(logr.Logger) (*api.Client, error)
 	if tac.client == nil {
 		tac.Lock()
 		defer tac.Unlock()
-		client, err := api.NewClient(api.DefaultConfig())
+		client, err := api.NewClient(newConfig())
 		if err != nil {
 			return nil, err
 		}
@@ -48,6 +65,9 @@ func (tac *TokenAuthenticatedClient) GetClient(logr.Logger) (*api.Client, error)
 	return tac.client, nil
 }
 
+// Close does nothing, as the token is not renewed
+func (tac *TokenAuthenticatedClient) Close() {}
+
 // ApproleAuthenticatedClient is the config
 // object required to create a Vault client that
 // authenticates using Vault's Approle auth backend
@@ -57,6 +77,8 @@ type ApproleAuthenticatedClient struct {
 	RoleID      string
 	BackendPath string
 	client      *api.Client
+	cancel      context.CancelFunc
+	done        chan struct{}
 	sync.Mutex
 }
 
@@ -73,34 +95,58 @@ func (aac *ApproleAuthenticatedClient) GetClient(logger logr.Logger) (*api.Clien
 	// client still not initialized
 	aac.Lock()
 	defer aac.Unlock()
+	if aac.client != nil {
+		return aac.client, nil
+	}
 
-	client, err := api.NewClient(api.DefaultConfig())
+	client, err := api.NewClient(newConfig())
 	if err != nil {
 		return nil, err
 	}
 	client.SetAddress(aac.Address)
 	client.SetClientTimeout(config.VaultApiTimeout)
 
+	// Update the client in the shared object
+	aac.client = client
+
 	// start the token lease renewal process
+	ctx, cancel := context.WithCancel(context.Background())
+	aac.cancel = cancel
+	aac.done = make(chan struct{})
 	go func() {
-		for {
-			vaultLoginResp, err := aac.login(context.Background(), logger)
+		defer close(aac.done)
+		for ctx.Err() == nil {
+			vaultLoginResp, err := aac.login(ctx, logger)
 			if err != nil {
 				logger.Error(err, "unable to authenticate to Vault")
+				select {
+				case <-time.After(loginRetryInterval):
+				case <-ctx.Done():
+				}
+				continue
 			}
-			tokenErr := aac.manageTokenLifecycle(vaultLoginResp, logger)
+			tokenErr := aac.manageTokenLifecycle(ctx, vaultLoginResp, logger)
 			if tokenErr != nil {
 				logger.Error(tokenErr, "unable to start managing token lifecycle")
 			}
 		}
 	}()
 
-	// Update the client in the shared object
-	aac.client = client
-
 	return aac.client, nil
 }
 
+// Close stops the token renewal process and waits for it to exit
+func (aac *ApproleAuthenticatedClient) Close() {
+	aac.Lock()
+	defer aac.Unlock()
+	if aac.cancel == nil {
+		return
+	}
+	aac.cancel()
+	<-aac.done
+	aac.cancel = nil
+}
+
 func (aac *ApproleAuthenticatedClient) login(ctx context.Context, logger logr.Logger) (*api.Secret, error) {
 
 	// request a new token using approle auth backend
@@ -127,7 +173,7 @@ func (aac *ApproleAuthenticatedClient) login(ctx context.Context, logger logr.Lo
 
 // Starts token lifecycle management. Returns only fatal errors as errors,
 // otherwise returns nil so we can attempt login again.
-func (aac *ApproleAuthenticatedClient) manageTokenLifecycle(token *api.Secret, logger logr.Logger) error {
+func (aac *ApproleAuthenticatedClient) manageTokenLifecycle(ctx context.Context, token *api.Secret, logger logr.Logger) error {
 	renew := token.Auth.Renewable
 	if !renew {
 		logger.V(1).Info("Token is not configured to be renewable. Re-attempting login.")
@@ -163,6 +209,10 @@ func (aac *ApproleAuthenticatedClient) manageTokenLifecycle(token *api.Secret, l
 		// Successfully completed renewal
 		case renewal := <-watcher.RenewCh():
 			logger.V(1).Info(fmt.Sprintf("Successfully renewed: %#v", renewal))
+
+		// The client is being closed
+		case <-ctx.Done():
+			return nil
 		}
 	}
 }